@@ -3,24 +3,22 @@ module github.com/danielnguyentb/url-shortener
 go 1.16
 
 require (
-	codeberg.org/ac/base62 v0.0.0-20210305150220-e793b546833a
-	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
-	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d
 	github.com/go-redis/redis/v8 v8.8.0
-	github.com/gomodule/redigo v1.8.4 // indirect
-	github.com/google/uuid v1.2.0
 	github.com/klauspost/shutdown2 v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/mssola/user_agent v0.5.3
+	github.com/oschwald/geoip2-golang v1.5.0
 	github.com/pkg/errors v0.9.1
 	github.com/rs/cors v1.7.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.7.0
-	github.com/yuin/gopher-lua v0.0.0-20200816102855-ee81675732da // indirect
 	go.mongodb.org/mongo-driver v1.5.0
 	go.uber.org/zap v1.16.0
-	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20210326220855-61e056675ecf
 	gorm.io/driver/mysql v1.0.5
 	gorm.io/driver/sqlite v1.1.4
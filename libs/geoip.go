@@ -0,0 +1,58 @@
+package libs
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	keyGeoIPPath = "geoip.path"
+)
+
+// GeoIP looks up the location of ip addresses in a local MaxMind database
+type GeoIP struct {
+	reader *geoip2.Reader
+}
+
+// NewGeoIPFromViper opens the configured MaxMind city database. Without a
+// database, lookups find nothing.
+func NewGeoIPFromViper(log *zap.Logger) (*GeoIP, error) {
+	path := viper.GetString(keyGeoIPPath)
+	if len(path) == 0 {
+		log.Warn(keyGeoIPPath + " is not provided, clicks are not located")
+		return &GeoIP{}, nil
+	}
+
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "geoip2.Open")
+	}
+
+	return &GeoIP{reader: reader}, nil
+}
+
+// Locate returns the iso country code and the english city name of an ip
+func (g *GeoIP) Locate(ip net.IP) (country, city string) {
+	if g == nil || g.reader == nil || ip == nil {
+		return "", ""
+	}
+
+	record, err := g.reader.City(ip)
+	if err != nil {
+		return "", ""
+	}
+
+	return record.Country.IsoCode, record.City.Names["en"]
+}
+
+func (g *GeoIP) Close() error {
+	if g == nil || g.reader == nil {
+		return nil
+	}
+
+	return g.reader.Close()
+}
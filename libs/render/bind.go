@@ -0,0 +1,274 @@
+package render
+
+import (
+	"encoding"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+)
+
+// maxMultipartMemory is the maximum bytes of a multipart body kept in memory,
+// the rest is stored on disk in temporary files.
+const maxMultipartMemory = 10 << 20
+
+// FieldError describes a single request field which could not be decoded or
+// did not pass validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// BindError is returned by Bind when one or more fields are invalid.
+type BindError struct {
+	Fields []FieldError
+}
+
+func (e *BindError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, strings.Join([]string{f.Field, f.Message}, ": "))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// FieldErrors returns the structured field errors carried by err, if any.
+func FieldErrors(err error) []FieldError {
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		return bindErr.Fields
+	}
+
+	return nil
+}
+
+// RegisterValidator makes fn available to `valid` struct tags under name.
+// Validators are global, so it should be called during initialization.
+func RegisterValidator(name string, fn func(str string) bool) {
+	govalidator.TagMap[name] = fn
+}
+
+// Bind decodes the request into 'v' and validates the result. The source is
+// picked by Content-Type: JSON, form-urlencoded or multipart bodies, falling
+// back to the query string for requests without a body.
+func Bind(r *http.Request, v interface{}) error {
+	if err := decode(r, v); err != nil {
+		return err
+	}
+
+	return Validate(v)
+}
+
+// Validate runs the registered validators against the `valid` tags of 'v'.
+func Validate(v interface{}) error {
+	if _, err := govalidator.ValidateStruct(v); err != nil {
+		fields := flattenValidationErrors(err, nil)
+		if len(fields) == 0 {
+			return errors.Wrap(err, "govalidator.ValidateStruct")
+		}
+
+		return &BindError{Fields: fields}
+	}
+
+	return nil
+}
+
+func decode(r *http.Request, v interface{}) error {
+	cT, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch {
+	case cT == "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return errors.Wrap(err, "r.ParseForm")
+		}
+		return DecodeValues(r.PostForm, v)
+	case cT == "multipart/form-data":
+		if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+			return errors.Wrap(err, "r.ParseMultipartForm")
+		}
+		return DecodeValues(r.MultipartForm.Value, v)
+	case cT == "application/json" || (len(cT) == 0 && hasBody(r)):
+		return decodeJSON(r.Body, v)
+	default:
+		return DecodeValues(r.URL.Query(), v)
+	}
+}
+
+// hasBody reports whether the request method is expected to carry a body.
+func hasBody(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodOptions:
+		return false
+	}
+
+	return true
+}
+
+func decodeJSON(r io.Reader, v interface{}) error {
+	defer func() {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			panic(err)
+		}
+	}()
+
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("request body is empty")
+		}
+		return errors.Wrap(err, "json.Decode")
+	}
+
+	return nil
+}
+
+// DecodeValues copies form or query values into the struct pointed by 'v'.
+// Fields are matched by their `form` tag, then their `json` tag, then their
+// name. Strings, booleans, numbers, slices, pointers and types implementing
+// encoding.TextUnmarshaler are supported.
+func DecodeValues(values url.Values, v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return errors.New("render: bind target must be a pointer to struct")
+	}
+
+	val = val.Elem()
+	var fields []FieldError
+	for i := 0; i < val.NumField(); i++ {
+		typeField := val.Type().Field(i)
+		if typeField.PkgPath != "" {
+			continue // Private field
+		}
+
+		name := fieldName(typeField)
+		if name == "-" {
+			continue
+		}
+
+		raw, ok := values[name]
+		if !ok || len(raw) == 0 {
+			continue
+		}
+
+		if err := setField(val.Field(i), raw); err != nil {
+			fields = append(fields, FieldError{Field: name, Message: err.Error()})
+		}
+	}
+
+	if len(fields) != 0 {
+		return &BindError{Fields: fields}
+	}
+
+	return nil
+}
+
+func fieldName(f reflect.StructField) string {
+	for _, tag := range []string{"form", "json"} {
+		if name := strings.Split(f.Tag.Get(tag), ",")[0]; len(name) != 0 {
+			return name
+		}
+	}
+
+	return f.Name
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func setField(field reflect.Value, raw []string) error {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setField(ptr.Elem(), raw); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	if reflect.PtrTo(field.Type()).Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw[0]))
+	}
+
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(raw), len(raw))
+		for i, s := range raw {
+			if err := setField(slice.Index(i), []string{s}); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	s := raw[0]
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		if len(s) == 0 {
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if len(s) == 0 {
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if len(s) == 0 {
+			return nil
+		}
+		n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive integer")
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if len(s) == 0 {
+			return nil
+		}
+		n, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(n)
+	default:
+		return errors.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// flattenValidationErrors turns the nested govalidator errors into a flat
+// list of field errors.
+func flattenValidationErrors(err error, fields []FieldError) []FieldError {
+	switch e := err.(type) {
+	case govalidator.Errors:
+		for _, inner := range e {
+			fields = flattenValidationErrors(inner, fields)
+		}
+	case govalidator.Error:
+		name := e.Name
+		if len(e.Path) != 0 {
+			name = strings.Join(append(e.Path, e.Name), ".")
+		}
+		fields = append(fields, FieldError{Field: name, Message: e.Err.Error()})
+	}
+
+	return fields
+}
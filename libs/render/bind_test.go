@@ -0,0 +1,83 @@
+package render
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bindRequest struct {
+	Url   string   `valid:"required,url" json:"url"`
+	Count int      `valid:"optional" json:"count"`
+	Tags  []string `valid:"optional" form:"tag" json:"tags"`
+	Debug *bool    `valid:"optional" json:"debug"`
+}
+
+func TestBind(t *testing.T) {
+	// JSON body without Content-Type
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(`{"url":"http://a.com","count":2}`))
+	req := &bindRequest{}
+	require.NoError(t, Bind(r, req))
+	assert.Equal(t, "http://a.com", req.Url)
+	assert.Equal(t, 2, req.Count)
+
+	// Form urlencoded body
+	form := url.Values{"url": {"http://b.com"}, "count": {"3"}, "tag": {"x", "y"}, "debug": {"true"}}
+	r, _ = http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = &bindRequest{}
+	require.NoError(t, Bind(r, req))
+	assert.Equal(t, "http://b.com", req.Url)
+	assert.Equal(t, 3, req.Count)
+	assert.Equal(t, []string{"x", "y"}, req.Tags)
+	require.NotNil(t, req.Debug)
+	assert.True(t, *req.Debug)
+
+	// Multipart body
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("url", "http://c.com"))
+	require.NoError(t, mw.Close())
+	r, _ = http.NewRequest("POST", "/", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	req = &bindRequest{}
+	require.NoError(t, Bind(r, req))
+	assert.Equal(t, "http://c.com", req.Url)
+
+	// Query string
+	r, _ = http.NewRequest("GET", "/?url=http://d.com&count=4", nil)
+	req = &bindRequest{}
+	require.NoError(t, Bind(r, req))
+	assert.Equal(t, "http://d.com", req.Url)
+	assert.Equal(t, 4, req.Count)
+
+	// Conversion errors are reported per field
+	r, _ = http.NewRequest("GET", "/?url=http://d.com&count=four", nil)
+	err := Bind(r, &bindRequest{})
+	require.Error(t, err)
+	assert.Equal(t, []FieldError{{Field: "count", Message: "must be an integer"}}, FieldErrors(err))
+
+	// Validation errors are reported per field
+	r, _ = http.NewRequest("GET", "/?url=abc", nil)
+	err = Bind(r, &bindRequest{})
+	require.Error(t, err)
+	fields := FieldErrors(err)
+	require.Len(t, fields, 1)
+	assert.Equal(t, "url", fields[0].Field)
+
+	// Custom validators
+	RegisterValidator("even", func(str string) bool {
+		return len(str)%2 == 0
+	})
+	err = Validate(&struct {
+		Value string `valid:"even" json:"value"`
+	}{Value: "abc"})
+	require.Error(t, err)
+	assert.Equal(t, "value", FieldErrors(err)[0].Field)
+}
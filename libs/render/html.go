@@ -0,0 +1,92 @@
+package render
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// layoutName is the template every page is executed through. Layouts define
+// it and pages fill the blocks it declares.
+const layoutName = "layout"
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]*template.Template{}
+)
+
+// TemplateFuncs are the helpers available to every template.
+var TemplateFuncs = template.FuncMap{
+	"formatTime": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("Jan 2, 2006 15:04 MST")
+	},
+}
+
+// LoadTemplates parses every page matching 'pages' in fsys together with the
+// layouts matching 'layouts'. A page is registered under its file name
+// without extension, i.e. "pages/home.html" is rendered with HTML(w, r, "home", v).
+func LoadTemplates(fsys fs.FS, layouts, pages string) error {
+	layoutFiles, err := fs.Glob(fsys, layouts)
+	if err != nil {
+		return errors.Wrap(err, "fs.Glob")
+	}
+
+	pageFiles, err := fs.Glob(fsys, pages)
+	if err != nil {
+		return errors.Wrap(err, "fs.Glob")
+	}
+
+	parsed := make(map[string]*template.Template, len(pageFiles))
+	for _, page := range pageFiles {
+		name := strings.TrimSuffix(path.Base(page), path.Ext(page))
+		files := append(append([]string{}, layoutFiles...), page)
+
+		tmpl, err := template.New(name).Funcs(TemplateFuncs).ParseFS(fsys, files...)
+		if err != nil {
+			return errors.Wrapf(err, "template.ParseFS %s", page)
+		}
+		parsed[name] = tmpl
+	}
+
+	templatesMu.Lock()
+	templates = parsed
+	templatesMu.Unlock()
+
+	return nil
+}
+
+// HTML executes the page template 'name' with 'v' and writes the result,
+// setting the Content-Type as text/html.
+func HTML(w http.ResponseWriter, r *http.Request, name string, v interface{}) {
+	templatesMu.RLock()
+	tmpl, ok := templates[name]
+	templatesMu.RUnlock()
+	if !ok {
+		http.Error(w, "template "+name+" is not loaded", http.StatusInternalServerError)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.ExecuteTemplate(buf, layoutName, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if status, ok := r.Context().Value(StatusCtxKey).(int); ok {
+		w.WriteHeader(status)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		panic(err)
+	}
+}
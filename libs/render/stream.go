@@ -0,0 +1,127 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// flushEvery is the number of items written between two flushes of a stream.
+const flushEvery = 100
+
+// Iterator yields the items of a streamed response one at a time.
+type Iterator interface {
+	// Next advances to the next item. It returns false once the items are
+	// exhausted or an error occurred.
+	Next() bool
+
+	// Value returns the current item.
+	Value() interface{}
+
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+}
+
+// NDJSON streams the items of 'it' as newline delimited JSON, setting the
+// Content-Type as application/x-ndjson.
+func NDJSON(w http.ResponseWriter, r *http.Request, it Iterator) error {
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	return stream(w, r, it, nil, nil, nil)
+}
+
+// JSONArray streams the items of 'it' as a single JSON array.
+func JSONArray(w http.ResponseWriter, r *http.Request, it Iterator) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return stream(w, r, it, []byte("["), []byte(","), []byte("]"))
+}
+
+// JSONObject streams a JSON object made of 'fields' plus the items of 'it' as
+// an array under 'key'. The whole object is never held in memory.
+func JSONObject(w http.ResponseWriter, r *http.Request, fields map[string]interface{}, key string, it Iterator) error {
+	head, err := json.Marshal(fields)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+
+	encodedKey, err := json.Marshal(key)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+
+	// Re-open the encoded fields object to append the streamed array
+	head = bytes.TrimSuffix(head, []byte("}"))
+	if len(fields) != 0 {
+		head = append(head, ',')
+	}
+	head = append(append(head, encodedKey...), ':', '[')
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return stream(w, r, it, head, []byte(","), []byte("]}"))
+}
+
+// stream writes every item of 'it' between 'open' and 'close', separated by
+// 'sep'. The output is flushed every flushEvery items and the stream stops as
+// soon as the client goes away.
+func stream(w http.ResponseWriter, r *http.Request, it Iterator, open, sep, close []byte) error {
+	if status, ok := r.Context().Value(StatusCtxKey).(int); ok {
+		w.WriteHeader(status)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	buf := bufio.NewWriter(w)
+	flush := func() error {
+		if err := buf.Flush(); err != nil {
+			return errors.Wrap(err, "buf.Flush")
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(true)
+
+	if _, err := buf.Write(open); err != nil {
+		return errors.Wrap(err, "buf.Write")
+	}
+
+	var count int
+	for it.Next() {
+		if err := r.Context().Err(); err != nil {
+			return errors.Wrap(err, "stream interrupted")
+		}
+
+		if count > 0 {
+			if _, err := buf.Write(sep); err != nil {
+				return errors.Wrap(err, "buf.Write")
+			}
+		}
+
+		if err := enc.Encode(it.Value()); err != nil {
+			return errors.Wrap(err, "enc.Encode")
+		}
+
+		count++
+		if count%flushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		// Flush what has been written so far, the client sees a truncated body
+		_ = flush()
+		return errors.Wrap(err, "it.Next")
+	}
+
+	if _, err := buf.Write(close); err != nil {
+		return errors.Wrap(err, "buf.Write")
+	}
+
+	return flush()
+}
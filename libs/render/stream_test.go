@@ -0,0 +1,90 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sliceIterator struct {
+	items []interface{}
+	pos   int
+	err   error
+}
+
+func (s *sliceIterator) Next() bool {
+	if s.pos >= len(s.items) {
+		return false
+	}
+	s.pos++
+	return true
+}
+
+func (s *sliceIterator) Value() interface{} {
+	return s.items[s.pos-1]
+}
+
+func (s *sliceIterator) Err() error {
+	return s.err
+}
+
+func TestStream(t *testing.T) {
+	items := make([]interface{}, 0, 250)
+	for i := 0; i < 250; i++ {
+		items = append(items, map[string]int{"n": i})
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	// NDJSON
+	w := httptest.NewRecorder()
+	require.NoError(t, NDJSON(w, r, &sliceIterator{items: items}))
+	assert.Equal(t, "application/x-ndjson; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.True(t, w.Flushed)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Len(t, lines, 250)
+	assert.Equal(t, `{"n":249}`, lines[249])
+
+	// JSON array
+	w = httptest.NewRecorder()
+	require.NoError(t, JSONArray(w, r, &sliceIterator{items: items}))
+	var array []map[string]int
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &array))
+	assert.Len(t, array, 250)
+
+	// Empty JSON array
+	w = httptest.NewRecorder()
+	require.NoError(t, JSONArray(w, r, &sliceIterator{}))
+	assert.Equal(t, "[]", w.Body.String())
+
+	// JSON object envelope
+	w = httptest.NewRecorder()
+	require.NoError(t, JSONObject(w, r, map[string]interface{}{"success": true}, "items", &sliceIterator{items: items[:2]}))
+	var envelope struct {
+		Success bool             `json:"success"`
+		Items   []map[string]int `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.True(t, envelope.Success)
+	assert.Len(t, envelope.Items, 2)
+
+	// Iterator failure
+	w = httptest.NewRecorder()
+	require.Error(t, JSONArray(w, r, &sliceIterator{items: items[:1], err: errors.New("boom")}))
+
+	// Client gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	err := NDJSON(w, r.WithContext(ctx), &sliceIterator{items: items})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, w.Body.String())
+}
@@ -1,19 +1,14 @@
 package libs
 
-import (
-	"encoding/json"
-	"io"
-	"io/ioutil"
-)
+import "unicode/utf8"
 
 const TimeFormat = "2006-01-02 15:04:05"
 
-func DecodeJSON(r io.Reader, v interface{}) error {
-	defer func() {
-		if _, err := io.Copy(ioutil.Discard, r); err != nil {
-			panic(err)
-		}
+// Clip cuts a value to a number of characters
+func Clip(value string, length int) string {
+	if utf8.RuneCountInString(value) <= length {
+		return value
+	}
 
-	}()
-	return json.NewDecoder(r).Decode(v)
+	return string([]rune(value)[:length])
 }
@@ -41,10 +41,15 @@ func serveCommand(zapLogger *zap.Logger) *cobra.Command {
 			r := core.NewRouter()
 
 			// Add middleware
-			r.Use(middlewares.Timeout(time.Minute))
+			r.Use(middlewares.TimeoutUnless(time.Minute, server.LongRequest))
 			r.Use(middlewares.Recoverer)
 			r.Use(libs.NewZapLogEntry(zapLogger))
-			r.Use(middlewares.AllowContentType("application/json", "text/javascript"))
+			r.Use(middlewares.AllowContentType(
+				"application/json",
+				"text/javascript",
+				"application/x-www-form-urlencoded",
+				"multipart/form-data",
+			))
 
 			// Add route
 			if err := server.AddRoutes(r, zapLogger); err != nil {
@@ -55,7 +60,8 @@ func serveCommand(zapLogger *zap.Logger) *cobra.Command {
 			c := cors.New(cors.Options{
 				AllowedOrigins:   []string{"*"},
 				AllowCredentials: true,
-				AllowedMethods:   []string{http.MethodPost, http.MethodGet, http.MethodPut, http.MethodDelete},
+				AllowedMethods:   []string{http.MethodPost, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete},
+				ExposedHeaders:   []string{"ETag"},
 			})
 
 			port := viper.GetString(portKey)
@@ -9,19 +9,56 @@ import (
 // Timeout is a middleware that cancels ctx after a given timeout and return
 // a 504 Gateway Timeout error to the client.
 func Timeout(timeout time.Duration) func(next http.Handler) http.Handler {
+	return TimeoutUnless(timeout, nil)
+}
+
+// TimeoutUnless is the Timeout middleware, skipped for the requests accepted
+// by 'exempt'. Exempt handlers set their own deadline, like streams which
+// outlast the default timeout.
+func TimeoutUnless(timeout time.Duration, exempt func(*http.Request) bool) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			if exempt != nil && exempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			tw := &timeoutWriter{ResponseWriter: w}
 			defer func() {
 				cancel()
-				if ctx.Err() == context.DeadlineExceeded {
+				// A response already started can't change its status
+				if ctx.Err() == context.DeadlineExceeded && !tw.started {
 					w.WriteHeader(http.StatusGatewayTimeout)
 				}
 			}()
 
 			r = r.WithContext(ctx)
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(tw, r)
 		}
 		return http.HandlerFunc(fn)
 	}
 }
+
+// timeoutWriter records whether the response started
+type timeoutWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		flusher.Flush()
+	}
+}
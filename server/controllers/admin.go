@@ -1,7 +1,11 @@
 package controllers
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
@@ -22,15 +26,70 @@ var (
 const (
 	keyAdmin           = "adminKey"
 	keyAuthorizeHeader = "Authorization"
+	// keyListTimeout bounds the admin list, streamed past the request timeout
+	keyListTimeout = "list.timeout"
+	// adminActor is recorded in the history of the links changed by admins
+	adminActor = "admin"
 )
 
+func init() {
+	viper.SetDefault(keyListTimeout, 30*time.Minute)
+}
+
 type AdminResponse struct {
-	Success bool         `json:"success"`
-	Items   []models.Url `json:"items"`
+	Success bool                `json:"success"`
+	Errors  []render.FieldError `json:"errors,omitempty"`
+	Items   []models.Url        `json:"items"`
+}
+
+// ListRequest holds the filters of the admin list
+type ListRequest struct {
+	Code   string `form:"code"`
+	Term   string `form:"term"`
+	Format string `form:"format" valid:"in(json|ndjson|array),optional"`
+}
+
+const (
+	listFormatNDJSON = "ndjson"
+	listFormatArray  = "array"
+	mimeNDJSON       = "application/x-ndjson"
+)
+
+// StatsRequest holds the period of the link stats. Times are utc, either
+// dates or date times, the period defaults to the last 7 days.
+type StatsRequest struct {
+	From     string `form:"from"`
+	To       string `form:"to"`
+	Interval string `form:"interval" valid:"in(hour|day),optional"`
+}
+
+// RollbackRequest holds the reason of a rollback, recorded in the history
+type RollbackRequest struct {
+	Reason string `valid:"optional,length(0|255)" json:"reason,omitempty"`
+}
+
+type HistoryResponse struct {
+	Success bool                 `json:"success"`
+	Items   []models.UrlRevision `json:"items"`
+}
+
+type StatsResponse struct {
+	Success bool                `json:"success"`
+	Errors  []render.FieldError `json:"errors,omitempty"`
+	Stats   *models.Stats       `json:"stats,omitempty"`
 }
 
+const (
+	// Period of the stats when none is requested
+	defaultStatsPeriod = 7 * 24 * time.Hour
+	// Number of buckets a time series can have
+	maxStatsPoints = 24 * 92
+	dateFormat     = "2006-01-02"
+)
+
 type Admin struct {
 	model *models.UrlModel
+	stats *models.StatsModel
 }
 
 func (a *Admin) GetList(w http.ResponseWriter, r *http.Request) {
@@ -40,29 +99,53 @@ func (a *Admin) GetList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var shortCode, keywords string
-	queries := r.URL.Query()
-	if len(queries.Get("code")) != 0 {
-		shortCode = queries.Get("code")
+	req := &ListRequest{}
+	if err := render.Bind(r, req); err != nil {
+		log.With(zap.Error(err)).Error("invalid list filters")
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, &AdminResponse{
+			Success: false,
+			Errors:  render.FieldErrors(err),
+		})
+		return
 	}
 
-	if len(queries.Get("term")) != 0 {
-		keywords = queries.Get("term")
-	}
+	// The list is exempt from the request timeout, it is bounded by its own
+	ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration(keyListTimeout))
+	defer cancel()
+	r = r.WithContext(ctx)
 
-	items, err := a.model.GetList(shortCode, keywords)
+	it, err := a.model.Iterate(ctx, req.Code, req.Term)
 	if err != nil {
 		log.With(zap.Error(err)).Error("failed to get list by criteria")
 		render.Status(r, http.StatusBadGateway)
 		render.JSON(w, r, &AdminResponse{
 			Success: false,
 		})
+		return
 	}
+	defer func() {
+		if err := it.Close(); err != nil {
+			log.With(zap.Error(err)).Error("it.Close")
+		}
+	}()
 
-	render.JSON(w, r, &AdminResponse{
-		Success: true,
-		Items:   items,
-	})
+	if len(req.Format) == 0 && strings.Contains(r.Header.Get("Accept"), mimeNDJSON) {
+		req.Format = listFormatNDJSON
+	}
+
+	switch req.Format {
+	case listFormatNDJSON:
+		err = render.NDJSON(w, r, it)
+	case listFormatArray:
+		err = render.JSONArray(w, r, it)
+	default:
+		err = render.JSONObject(w, r, map[string]interface{}{"success": true}, "items", it)
+	}
+
+	if err != nil {
+		log.With(zap.Error(err)).Error("failed to stream list")
+	}
 }
 
 func (a *Admin) Delete(w http.ResponseWriter, r *http.Request) {
@@ -81,9 +164,249 @@ func (a *Admin) Delete(w http.ResponseWriter, r *http.Request) {
 
 	log = log.With(zap.String("code", shortenCode))
 
-	// Find shorten item
-	item, err := a.model.FindByShortCode(shortenCode, true)
-	if err != nil && !errors.Is(err, models.ErrExpired) {
+	// Purged links are removed for good, along with their clicks and history
+	if r.URL.Query().Get("purge") == "true" {
+		if err := a.model.Purge(shortenCode); err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				render.Status(r, http.StatusNotFound)
+				render.NoContent(w, r)
+				return
+			}
+
+			log.With(zap.Error(err)).Error("fail to purge url")
+			render.Status(r, http.StatusBadGateway)
+			render.NoContent(w, r)
+			return
+		}
+
+		log.Info("Shorten url purged")
+		render.NoContent(w, r)
+		return
+	}
+
+	// Soft delete item
+	if ok, err := a.model.Delete(shortenCode, adminActor); err != nil || !ok {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			render.Status(r, http.StatusNotFound)
+		case errors.Is(err, models.ErrInvalidTransition):
+			render.Status(r, http.StatusConflict)
+		default:
+			log.With(zap.Error(err)).Error("fail to delete url")
+			render.Status(r, http.StatusBadRequest)
+		}
+	}
+
+	render.NoContent(w, r)
+	return
+}
+
+// Get responds with a link and its ETag
+func (a *Admin) Get(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	getLink(w, r, a.model, "")
+}
+
+// Update changes the destination, times or status of any link
+func (a *Admin) Update(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	updateLink(w, r, a.model, "", adminActor)
+}
+
+// Restore enables a deleted link again
+func (a *Admin) Restore(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	item, err := a.model.Restore(shortenCode, adminActor)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, models.ErrNotDeleted), errors.Is(err, models.ErrVersionConflict):
+			status = http.StatusConflict
+		}
+
+		log.With(zap.Error(err)).Info("fail to restore link")
+		render.Status(r, status)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.Info("Shorten url restored")
+	w.Header().Set(keyETagHeader, item.ETag())
+	render.JSON(w, r, LinkResponse{
+		Success: true,
+		Item:    item,
+	})
+}
+
+// History lists the revisions of a link, latest first
+func (a *Admin) History(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	if _, err := a.model.Get(shortenCode, ""); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			render.Status(r, http.StatusNotFound)
+			render.NoContent(w, r)
+			return
+		}
+
+		log.With(zap.Error(err)).Error("fail to get link")
+		render.Status(r, http.StatusBadGateway)
+		render.JSON(w, r, &HistoryResponse{
+			Success: false,
+		})
+		return
+	}
+
+	revisions, err := a.model.History(shortenCode)
+	if err != nil {
+		log.With(zap.Error(err)).Error("failed to get history")
+		render.Status(r, http.StatusBadGateway)
+		render.JSON(w, r, &HistoryResponse{
+			Success: false,
+		})
+		return
+	}
+
+	render.JSON(w, r, &HistoryResponse{
+		Success: true,
+		Items:   revisions,
+	})
+}
+
+// Rollback restores a revision of a link, as an update recorded in its history
+func (a *Admin) Rollback(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	params := core.RouteContext(r.Context()).RouteParams
+	shortenCode := params.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	revision, err := strconv.ParseUint(params.Get("rev"), 10, 32)
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.NoContent(w, r)
+		return
+	}
+
+	version, err := parseIfMatch(r.Header.Get(keyIfMatchHeader))
+	if err != nil {
+		render.Status(r, http.StatusPreconditionFailed)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	req := &RollbackRequest{}
+	if hasRequestBody(r) {
+		if err := render.Bind(r, req); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, LinkResponse{
+				Success: false,
+				Message: err.Error(),
+				Errors:  render.FieldErrors(err),
+			})
+			return
+		}
+	}
+
+	item, err := a.model.Rollback(shortenCode, uint(revision), version, adminActor, req.Reason)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, models.ErrVersionConflict):
+			status = http.StatusPreconditionFailed
+		case errors.Is(err, models.ErrInvalidTransition):
+			status = http.StatusConflict
+		}
+
+		log.With(zap.Error(err)).Info("fail to roll back link")
+		render.Status(r, status)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.With(zap.Uint64("revision", revision)).Info("Shorten url rolled back")
+	w.Header().Set(keyETagHeader, item.ETag())
+	render.JSON(w, r, LinkResponse{
+		Success: true,
+		Item:    item,
+	})
+}
+
+func (a *Admin) Stats(w http.ResponseWriter, r *http.Request) {
+	log, err := a.parseRequestAndValidate(w, r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("invalid request")
+		return
+	}
+
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	req := &StatsRequest{}
+	if err := render.Bind(r, req); err != nil {
+		log.With(zap.Error(err)).Error("invalid stats request")
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, &StatsResponse{
+			Success: false,
+			Errors:  render.FieldErrors(err),
+		})
+		return
+	}
+
+	from, to, interval, fieldErrors := req.period(time.Now())
+	if len(fieldErrors) != 0 {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, &StatsResponse{
+			Success: false,
+			Errors:  fieldErrors,
+		})
+		return
+	}
+
+	// Links keep their stats whatever their state
+	if _, err := a.model.Get(shortenCode, ""); err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			render.Status(r, http.StatusNotFound)
 			render.NoContent(w, r)
@@ -96,15 +419,78 @@ func (a *Admin) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Soft delete item
-	if ok, err := a.model.Delete(item.Key); err != nil || !ok {
-		render.Status(r, http.StatusBadRequest)
+	stats, err := a.stats.Stats(shortenCode, from, to, interval)
+	if err != nil {
+		log.With(zap.Error(err)).Error("failed to get stats")
+		render.Status(r, http.StatusBadGateway)
+		render.JSON(w, r, &StatsResponse{
+			Success: false,
+		})
+		return
+	}
+
+	render.JSON(w, r, &StatsResponse{
+		Success: true,
+		Stats:   stats,
+	})
+}
+
+// period checks the requested period against the current time
+func (req *StatsRequest) period(now time.Time) (from, to time.Time, interval string, fieldErrors []render.FieldError) {
+	interval = req.Interval
+	if len(interval) == 0 {
+		interval = models.IntervalDay
+	}
+
+	to = now.UTC()
+	if len(req.To) != 0 {
+		var err error
+		if to, err = parseStatsTime(req.To); err != nil {
+			fieldErrors = append(fieldErrors, render.FieldError{Field: "to", Message: err.Error()})
+		}
+	}
+
+	from = to.Add(-defaultStatsPeriod)
+	if len(req.From) != 0 {
+		var err error
+		if from, err = parseStatsTime(req.From); err != nil {
+			fieldErrors = append(fieldErrors, render.FieldError{Field: "from", Message: err.Error()})
+		}
+	}
+
+	if len(fieldErrors) != 0 {
+		return
+	}
+
+	if !from.Before(to) {
+		fieldErrors = append(fieldErrors, render.FieldError{Field: "from", Message: "from must be before to"})
+		return
+	}
+
+	step := time.Hour
+	if interval == models.IntervalDay {
+		step = 24 * time.Hour
+	}
+	if to.Sub(from)/step > maxStatsPoints {
+		fieldErrors = append(fieldErrors, render.FieldError{Field: "interval", Message: "period has too many buckets for the interval"})
 	}
 
-	render.NoContent(w, r)
 	return
 }
 
+func parseStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(libs.TimeFormat, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(dateFormat, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("%s does not validate as %s or %s", value, libs.TimeFormat, dateFormat)
+	}
+
+	return t, nil
+}
+
 func (a *Admin) parseRequestAndValidate(w http.ResponseWriter, r *http.Request) (log *zap.Logger, err error) {
 	log = libs.GetLogEntry(r)
 
@@ -125,7 +511,13 @@ func NewAdminController(log *zap.Logger, client *redis.Client, db *gorm.DB) (*Ad
 		return nil, errors.Wrap(err, "NewUrlController")
 	}
 
+	stats, err := models.NewStatsModel(log, client, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "models.NewStatsModel")
+	}
+
 	return &Admin{
 		model: model,
+		stats: stats,
 	}, nil
 }
@@ -9,8 +9,9 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -53,6 +54,13 @@ func TestAdminCtrl(t *testing.T) {
 	r := core.NewRouter()
 	r.Get("/admin/list", adminCtrl.GetList)
 	r.Delete("/admin/:code", adminCtrl.Delete)
+	r.Get("/admin/links/:code/stats", adminCtrl.Stats)
+	r.Get("/admin/links/:code", adminCtrl.Get)
+	r.Patch("/admin/links/:code", adminCtrl.Update)
+	r.Get("/admin/links/:code/history", adminCtrl.History)
+	r.Post("/admin/links/:code/rollback/:rev", adminCtrl.Rollback)
+	r.Post("/admin/links/:code/restore", adminCtrl.Restore)
+	r.Delete("/admin/links/:code", adminCtrl.Delete)
 
 	log.Debug("Request admin without token key")
 	resp, _, err := testAdminHandler(log, r, "GET", "/admin/list", "", strings.NewReader(""))
@@ -79,6 +87,29 @@ func TestAdminCtrl(t *testing.T) {
 	assert.NotEmpty(t, res.Items)
 	assert.Equal(t, len(res.Items), 3)
 
+	log.Debug("Request admin list streamed as NDJSON")
+	req, _ := http.NewRequest("GET", "/admin/list?format=ndjson", nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w := httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/x-ndjson")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	streamed := models.Url{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &streamed))
+	assert.Equal(t, item1.Key, streamed.Key)
+
+	log.Debug("Request admin list streamed as JSON array")
+	req, _ = http.NewRequest("GET", "/admin/list?format=array", nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var array []models.Url
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &array))
+	assert.Len(t, array, 3)
+
 	log.Debug("Request admin list and short-code criteria filtering with correct item returned")
 	resp, res, err = testAdminHandler(log, r, "GET", strings.Join([]string{"/admin/list?code=", item1.Key}, ""), adminKey, strings.NewReader(""))
 	require.NoError(t, err)
@@ -110,6 +141,149 @@ func TestAdminCtrl(t *testing.T) {
 	assert.NotEmpty(t, res.Items)
 	assert.Equal(t, len(res.Items), 1)
 	assert.False(t, res.Items[0].Status)
+
+	getStats := func(path string) (*http.Response, *StatsResponse) {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Add(keyAuthorizeHeader, adminKey)
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+		stats := &StatsResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), stats))
+		return w.Result(), stats
+	}
+
+	log.Debug("Stats of an unknown link, not found expected")
+	req, _ = http.NewRequest("GET", "/admin/links/non-exists/stats", nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	log.Debug("Stats with invalid period, bad request expected")
+	resp, stats := getStats("/admin/links/" + item1.Key + "/stats?from=2021-04-10&to=2021-04-01")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Len(t, stats.Errors, 1)
+	assert.Equal(t, "from", stats.Errors[0].Field)
+
+	resp, stats = getStats("/admin/links/" + item1.Key + "/stats?interval=week")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	log.Debug("Stats of a deleted link by hour")
+	resp, stats = getStats("/admin/links/" + item1.Key + "/stats?from=2021-04-01&to=2021-04-02&interval=hour")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, stats.Success)
+	assert.Equal(t, item1.Key, stats.Stats.Code)
+	assert.Len(t, stats.Stats.Series, 24)
+	assert.Equal(t, uint64(0), stats.Stats.Clicks)
+
+	patchLink := func(code, ifMatch, body string) (*http.Response, *LinkResponse) {
+		req, _ := http.NewRequest("PATCH", "/admin/links/"+code, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Add(keyAuthorizeHeader, adminKey)
+		if len(ifMatch) != 0 {
+			req.Header.Set(keyIfMatchHeader, ifMatch)
+		}
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+		link := &LinkResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), link))
+		return w.Result(), link
+	}
+
+	log.Debug("Get link responds with its ETag")
+	req, _ = http.NewRequest("GET", "/admin/links/"+item2.Key, nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get(keyETagHeader)
+	assert.Equal(t, `"1"`, etag)
+
+	log.Debug("Patch link destination with matching ETag, the cache is rewritten")
+	resp, link := patchLink(item2.Key, etag, `{"url": "http://url-2.com/fixed"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, link.Success)
+	assert.Equal(t, `"2"`, resp.Header.Get(keyETagHeader))
+	lookup, err := model.FindByShortCode(item2.Key, false)
+	require.NoError(t, err)
+	assert.Equal(t, "http://url-2.com/fixed", lookup.Origin)
+
+	log.Debug("Patch link with stale ETag, precondition failed expected")
+	resp, _ = patchLink(item2.Key, etag, `{"status": false}`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	log.Debug("Patch link with invalid values, bad request expected")
+	resp, link = patchLink(item2.Key, "", `{"url": "not a url"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Len(t, link.Errors, 1)
+	assert.Equal(t, "url", link.Errors[0].Field)
+	resp, _ = patchLink(item2.Key, "", `{"expire": "2001-01-01 00:00:00"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	log.Debug("Patch unknown link, not found expected")
+	resp, _ = patchLink("non-exists", "", `{"status": false}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	log.Debug("History lists the revisions of the link")
+	req, _ = http.NewRequest("GET", "/admin/links/"+item2.Key+"/history", nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	history := &HistoryResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), history))
+	require.Len(t, history.Items, 2)
+	assert.Equal(t, adminActor, history.Items[0].Actor)
+	assert.Equal(t, "http://url-2.com/fixed", history.Items[0].Origin)
+
+	log.Debug("Rollback restores the first revision")
+	req, _ = http.NewRequest("POST", "/admin/links/"+item2.Key+"/rollback/1", strings.NewReader(`{"reason": "typo"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get(keyETagHeader))
+	lookup, err = model.FindByShortCode(item2.Key, false)
+	require.NoError(t, err)
+	assert.Equal(t, "http://url-2.com", lookup.Origin)
+
+	log.Debug("Rollback to an unknown revision, not found expected")
+	req, _ = http.NewRequest("POST", "/admin/links/"+item2.Key+"/rollback/9", nil)
+	req.Header.Add(keyAuthorizeHeader, adminKey)
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	log.Debug("Patch link to a state it can not reach, conflict expected")
+	resp, _ = patchLink(item2.Key, "", `{"state": "unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = patchLink(item2.Key, "", `{"state": "takedown", "reason": "court order"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = patchLink(item2.Key, "", `{"state": "flagged"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = patchLink(item2.Key, "", `{"state": "active"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	log.Debug("Restore a deleted link, restoring it again conflicts")
+	resp, _, err = testAdminHandler(log, r, "POST", "/admin/links/"+item1.Key+"/restore", adminKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = model.FindByShortCode(item1.Key, false)
+	require.NoError(t, err)
+	resp, _, err = testAdminHandler(log, r, "POST", "/admin/links/"+item1.Key+"/restore", adminKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	log.Debug("Purge a link, it is gone for good")
+	resp, _, err = testAdminHandler(log, r, "DELETE", "/admin/links/"+item1.Key+"?purge=true", adminKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = model.Get(item1.Key, "")
+	assert.True(t, errors.Is(err, models.ErrNotFound))
+	resp, _, err = testAdminHandler(log, r, "DELETE", "/admin/links/"+item1.Key+"?purge=true", adminKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
 
 func testAdminHandler(log *zap.Logger, h http.Handler, method, path, adminKey string, body io.Reader) (*http.Response, *AdminResponse, error) {
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// keyBotPatterns replaces the user agent patterns of the bots
+	keyBotPatterns = "bots.patterns"
+	// keyBotRequireAcceptLanguage flags requests without Accept-Language, api
+	// clients rarely send it so it is opt-in
+	keyBotRequireAcceptLanguage = "bots.requireAcceptLanguage"
+	// keyBotBurstLimit flags the ips redirected more than this per window, 0 disables it
+	keyBotBurstLimit  = "bots.burstLimit"
+	keyBotBurstWindow = "bots.burstWindow"
+)
+
+// Reasons a request is classified as a bot
+const (
+	BotReasonUserAgent      = "user-agent"
+	BotReasonHead           = "head"
+	BotReasonAcceptLanguage = "no-accept-language"
+	BotReasonBurst          = "burst"
+	BotReasonEmptyUserAgent = "empty-user-agent"
+)
+
+// defaultBotPatterns match the user agents of crawlers, link unfurlers,
+// monitoring services, security scanners and http libraries. Browsers, mail
+// apps and in-app browsers of people, like the DuckDuckGo browser, Outlook or
+// the Slack and Pinterest apps, are not bots.
+var defaultBotPatterns = []string{
+	`bot\b`, `bot/`, `crawl`, `spider`, `slurp`, `scan`, `feedfetcher`,
+	`facebookexternalhit`, `facebookcatalog`, `slackbot`, `slack-imgproxy`,
+	`twitterbot`, `discordbot`, `telegrambot`, `skypeuripreview`, `linkedinbot`,
+	`pinterestbot`, `embedly`, `quora link preview`, `vkshare`, `redditbot`, `applebot`,
+	`google-inspectiontool`, `googleother`, `bingpreview`, `yahoo! slurp`,
+	`duckduckbot`, `duckassistbot`, `baiduspider`, `yandex`, `sogou`, `exabot`, `ia_archiver`,
+	`headlesschrome`, `phantomjs`, `puppeteer`, `playwright`, `selenium`,
+	`curl/`, `wget/`, `python-requests`, `python-urllib`, `aiohttp`, `httpx`,
+	`go-http-client`, `java/`, `okhttp`, `apache-httpclient`, `libwww-perl`,
+	`node-fetch`, `axios/`, `postmanruntime`, `insomnia`,
+	`pingdom`, `uptimerobot`, `statuscake`, `site24x7`, `datadog`, `newrelic`,
+	`nessus`, `nmap`, `nikto`, `sqlmap`, `masscan`, `zgrab`, `censys`,
+	`shodan`, `qualys`, `netcraft`, `urlscan`, `virustotal`, `safebrowsing`,
+	`proofpoint`, `mimecast`, `barracuda`,
+}
+
+// BotVerdict is the classification of a request
+type BotVerdict struct {
+	Bot    bool
+	Reason string
+}
+
+// BotDetector classifies the redirect requests sent by bots, from their user
+// agent and a few heuristics
+type BotDetector struct {
+	redis *redis.Client
+
+	mu       sync.Mutex
+	source   []string
+	patterns *regexp.Regexp
+}
+
+func init() {
+	viper.SetDefault(keyBotRequireAcceptLanguage, false)
+	viper.SetDefault(keyBotBurstLimit, 30)
+	viper.SetDefault(keyBotBurstWindow, 10*time.Second)
+}
+
+func NewBotDetector(client *redis.Client) *BotDetector {
+	return &BotDetector{redis: client}
+}
+
+// Classify tells whether a request comes from a bot. The burst rate is
+// counted for every human looking request, so it reaches redis.
+func (d *BotDetector) Classify(r *http.Request) (BotVerdict, error) {
+	ua := strings.TrimSpace(r.UserAgent())
+	if len(ua) == 0 {
+		return BotVerdict{Bot: true, Reason: BotReasonEmptyUserAgent}, nil
+	}
+
+	patterns, err := d.compiled()
+	if err != nil {
+		return BotVerdict{}, err
+	}
+	if patterns != nil && patterns.MatchString(ua) {
+		return BotVerdict{Bot: true, Reason: BotReasonUserAgent}, nil
+	}
+
+	// Unfurlers and link checkers often only look at the headers
+	if r.Method == http.MethodHead {
+		return BotVerdict{Bot: true, Reason: BotReasonHead}, nil
+	}
+
+	if viper.GetBool(keyBotRequireAcceptLanguage) && len(r.Header.Get("Accept-Language")) == 0 {
+		return BotVerdict{Bot: true, Reason: BotReasonAcceptLanguage}, nil
+	}
+
+	burst, err := d.isBurst(r.Context(), clientIP(r).String())
+	if err != nil {
+		return BotVerdict{}, err
+	}
+	if burst {
+		return BotVerdict{Bot: true, Reason: BotReasonBurst}, nil
+	}
+
+	return BotVerdict{}, nil
+}
+
+// isBurst counts the redirects of an ip in the current window
+func (d *BotDetector) isBurst(ctx context.Context, ip string) (bool, error) {
+	limit := viper.GetInt64(keyBotBurstLimit)
+	window := viper.GetDuration(keyBotBurstWindow)
+	if limit <= 0 || window <= 0 {
+		return false, nil
+	}
+
+	// The ip is hashed, the key only lives for a window
+	sum := sha256.Sum256([]byte(ip))
+	slot := time.Now().UnixNano() / int64(window)
+	key := strings.Join([]string{"bots-burst", hex.EncodeToString(sum[:8]), strconv.FormatInt(slot, 10)}, "-")
+
+	incr := &redis.IntCmd{}
+	if _, err := d.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, window)
+		return nil
+	}); err != nil {
+		return false, errors.Wrap(err, "d.redis.Pipelined")
+	}
+
+	return incr.Val() > limit, nil
+}
+
+// compiled returns the user agent patterns, compiled again when the config
+// changes
+func (d *BotDetector) compiled() (*regexp.Regexp, error) {
+	source := defaultBotPatterns
+	if viper.IsSet(keyBotPatterns) {
+		source = viper.GetStringSlice(keyBotPatterns)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.source != nil && equalStrings(d.source, source) {
+		return d.patterns, nil
+	}
+
+	var patterns *regexp.Regexp
+	if len(source) != 0 {
+		var err error
+		if patterns, err = regexp.Compile("(?i)(" + strings.Join(source, "|") + ")"); err != nil {
+			return nil, errors.Wrap(err, keyBotPatterns)
+		}
+	}
+
+	d.source, d.patterns = source, patterns
+	return patterns, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
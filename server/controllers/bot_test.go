@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+	"(KHTML, like Gecko) Chrome/89.0.4389.114 Safari/537.36"
+
+func TestBotDetector(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	detector := NewBotDetector(redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	}))
+
+	classify := func(method, ip, ua, language string) BotVerdict {
+		req, _ := http.NewRequest(method, "/r/abc", nil)
+		req.RemoteAddr = ip + ":41234"
+		req.Header.Set("User-Agent", ua)
+		if len(language) != 0 {
+			req.Header.Set("Accept-Language", language)
+		}
+		verdict, err := detector.Classify(req)
+		require.NoError(t, err)
+		return verdict
+	}
+
+	assert.Equal(t, BotVerdict{}, classify("GET", "203.0.113.1", browserUserAgent, "en-US"))
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonUserAgent},
+		classify("GET", "203.0.113.1", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "en-US"))
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonUserAgent},
+		classify("GET", "203.0.113.1", "Twitterbot/1.0", ""))
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonEmptyUserAgent}, classify("GET", "203.0.113.1", "", "en-US"))
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonHead}, classify("HEAD", "203.0.113.1", browserUserAgent, "en-US"))
+	assert.Equal(t, BotVerdict{}, classify("GET", "203.0.113.1", browserUserAgent, ""))
+
+	// Requests without Accept-Language are only flagged when configured
+	viper.Set(keyBotRequireAcceptLanguage, true)
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonAcceptLanguage}, classify("GET", "203.0.113.1", browserUserAgent, ""))
+	viper.Set(keyBotRequireAcceptLanguage, false)
+
+	// Crawlers are told apart from the browsers and mail apps of people
+	assert.True(t, classify("GET", "203.0.113.2", "DuckDuckBot/1.1; (+http://duckduckgo.com/duckduckbot.html)", "en-US").Bot)
+	assert.True(t, classify("GET", "203.0.113.2", "Mozilla/5.0 (compatible; DuckAssistBot/1.0; +https://duckduckgo.com/duckassistbot)", "en-US").Bot)
+	for _, ua := range []string{
+		"Mozilla/5.0 (Linux; Android 13) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/116.0.0.0 Mobile Safari/537.36 DuckDuckGo/5",
+		"Mozilla/4.0 (compatible; ms-office; MSOffice 16) Microsoft Outlook 16.0.5017; Pro",
+		"Microsoft Office/16.0 (Windows NT 10.0; Microsoft Word 16.0.4266; Pro)",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 16_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [Pinterest/iOS]",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Slack/4.33.90 Chrome/114.0.5735.289 Electron/25.2.0 Safari/537.36 Sonic Slack_SSB/4.33.90",
+		"Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36 Discord/194.0",
+	} {
+		assert.False(t, classify("GET", "203.0.113.2", ua, "en-US").Bot, ua)
+	}
+
+	// Bursts of an ip are flagged, other ips are not
+	viper.Set(keyBotBurstLimit, 3)
+	defer viper.Set(keyBotBurstLimit, 30)
+	for i := 0; i < 3; i++ {
+		assert.False(t, classify("GET", "198.51.100.7", browserUserAgent, "vi").Bot)
+	}
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonBurst}, classify("GET", "198.51.100.7", browserUserAgent, "vi"))
+	assert.False(t, classify("GET", "198.51.100.8", browserUserAgent, "vi").Bot)
+
+	// Patterns of the config replace the built-in ones
+	viper.Set(keyBotPatterns, []string{"chrome/89"})
+	defer viper.Set(keyBotPatterns, nil)
+	assert.Equal(t, BotVerdict{Bot: true, Reason: BotReasonUserAgent}, classify("GET", "192.0.2.1", browserUserAgent, "en"))
+	assert.False(t, classify("GET", "192.0.2.1", "Twitterbot/1.0", "en").Bot)
+}
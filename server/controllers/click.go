@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mssola/user_agent"
+	"github.com/spf13/viper"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyClicksTrustProxy reads the client ip from X-Forwarded-For, only
+	// enable it behind a proxy setting the header
+	keyClicksTrustProxy = "clicks.trustProxy"
+)
+
+// Sizes of the click columns filled from the request, longer values would
+// fail the whole batch of events on strict databases
+const (
+	maxReferrerLength = 2048
+	maxAgentLength    = 64
+	maxCityLength     = 128
+)
+
+// locator finds the country and city of an ip
+type locator interface {
+	Locate(ip net.IP) (country, city string)
+}
+
+// newClickEvent describes the redirect of a request through a short code
+func newClickEvent(r *http.Request, code string, geo locator) models.ClickEvent {
+	event := models.ClickEvent{
+		Code:     code,
+		Referrer: libs.Clip(r.Referer(), maxReferrerLength),
+	}
+
+	if r.URL.Query().Get(sourceParam) == sourceQr {
+		event.Source = sourceQr
+	}
+
+	ua := user_agent.New(r.UserAgent())
+	browser, version := ua.Browser()
+	event.Browser, event.BrowserVersion = libs.Clip(browser, maxAgentLength), libs.Clip(version, maxAgentLength)
+	event.OS = libs.Clip(ua.OSInfo().Name, maxAgentLength)
+	switch {
+	case ua.Bot():
+		event.Device = models.DeviceBot
+	case ua.Mobile():
+		event.Device = models.DeviceMobile
+	default:
+		event.Device = models.DeviceDesktop
+	}
+
+	ip := clientIP(r)
+	event.IP = models.AnonymizeIP(ip)
+	country, city := geo.Locate(ip)
+	event.Country, event.City = country, libs.Clip(city, maxCityLength)
+
+	return event
+}
+
+// clientIP returns the ip of the client sending the request
+func clientIP(r *http.Request) net.IP {
+	if viper.GetBool(keyClicksTrustProxy) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) != 0 {
+			return net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
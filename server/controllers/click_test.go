@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+type staticLocator struct{}
+
+func (staticLocator) Locate(ip net.IP) (string, string) {
+	return "VN", "Hanoi"
+}
+
+func TestNewClickEvent(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/r/abc", nil)
+	req.RemoteAddr = "203.0.113.42:51234"
+	req.Header.Set("Referer", "https://news.example.com/")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) "+
+		"AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.3 Mobile/15E148 Safari/604.1")
+
+	event := newClickEvent(req, "abc", staticLocator{})
+	assert.Equal(t, "abc", event.Code)
+	assert.Equal(t, "https://news.example.com/", event.Referrer)
+	assert.Equal(t, "Safari", event.Browser)
+	assert.Equal(t, "iPhone OS", event.OS)
+	assert.Equal(t, models.DeviceMobile, event.Device)
+	assert.Equal(t, "203.0.113.0", event.IP)
+	assert.Equal(t, "VN", event.Country)
+	assert.Equal(t, "Hanoi", event.City)
+
+	req.Header.Set("User-Agent", "Googlebot/2.1 (+http://www.google.com/bot.html)")
+	assert.Equal(t, models.DeviceBot, newClickEvent(req, "abc", staticLocator{}).Device)
+
+	// Values longer than their column are cut
+	req.Header.Set("Referer", "https://news.example.com/?q="+strings.Repeat("é", 3000))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) "+
+		"Chrome/"+strings.Repeat("9", 100)+" Safari/537.36")
+	event = newClickEvent(req, "abc", staticLocator{})
+	assert.Equal(t, maxReferrerLength, utf8.RuneCountInString(event.Referrer))
+	assert.True(t, utf8.ValidString(event.Referrer))
+	assert.Equal(t, maxAgentLength, len(event.BrowserVersion))
+}
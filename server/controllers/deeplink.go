@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/mssola/user_agent"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyWellKnownAppleAppSiteAssociation and keyWellKnownAssetLinks are json
+	// documents served as is on the short domain, to verify the app links
+	keyWellKnownAppleAppSiteAssociation = "wellKnown.appleAppSiteAssociation"
+	keyWellKnownAssetLinks              = "wellKnown.assetLinks"
+)
+
+// DeepLinkRequest sets the apps opened by a link on mobiles. App urls are
+// custom scheme urls, universal links or Android intent uris.
+type DeepLinkRequest struct {
+	Ios          string `valid:"optional,appurl" json:"ios,omitempty"`
+	IosStore     string `valid:"optional,url" json:"ios_store,omitempty"`
+	Android      string `valid:"optional,appurl" json:"android,omitempty"`
+	AndroidStore string `valid:"optional,url" json:"android_store,omitempty"`
+	Web          string `valid:"optional,url" json:"web,omitempty"`
+}
+
+// HandoffPage is the data of the page opening the app of a link, visitors
+// without the app are sent to the fallback
+type HandoffPage struct {
+	// App is checked against the scripts schemes before being stored
+	App      template.URL
+	Fallback string
+}
+
+// WellKnown serves the documents verifying the app links of the short domain
+type WellKnown struct {
+	appleAppSiteAssociation json.RawMessage
+	assetLinks              json.RawMessage
+}
+
+func init() {
+	render.RegisterValidator("appurl", models.ValidAppUrl)
+}
+
+// deepLink converts the requested deep link
+func (req *DeepLinkRequest) deepLink() models.DeepLink {
+	if req == nil {
+		return models.DeepLink{}
+	}
+
+	return models.DeepLink{
+		Ios:          req.Ios,
+		IosStore:     req.IosStore,
+		Android:      req.Android,
+		AndroidStore: req.AndroidStore,
+		Web:          req.Web,
+	}
+}
+
+// mobilePlatform returns the mobile platform of a request, empty for the
+// other devices
+func mobilePlatform(r *http.Request) string {
+	ua := user_agent.New(r.UserAgent())
+	switch {
+	case appleMobiles[ua.Platform()]:
+		return models.PlatformIOS
+	case ua.OSInfo().Name == "Android":
+		return models.PlatformAndroid
+	}
+
+	return ""
+}
+
+// handoff renders the page opening the app of a link for the mobiles it is
+// set up for. It reports false when the visitor is redirected as usual.
+func handoff(w http.ResponseWriter, r *http.Request, item *models.Url, destination string) bool {
+	app, fallback := item.DeepLink.Handoff(mobilePlatform(r), destination)
+	if len(app) == 0 {
+		return false
+	}
+
+	render.HTML(w, r, "handoff", HandoffPage{
+		App:      template.URL(app),
+		Fallback: fallback,
+	})
+	return true
+}
+
+// NewWellKnownController reads the configured documents, they must be json
+func NewWellKnownController(log *zap.Logger) (*WellKnown, error) {
+	k := &WellKnown{}
+	for key, document := range map[string]*json.RawMessage{
+		keyWellKnownAppleAppSiteAssociation: &k.appleAppSiteAssociation,
+		keyWellKnownAssetLinks:              &k.assetLinks,
+	} {
+		raw := viper.GetString(key)
+		if len(raw) == 0 {
+			log.Info(key + " is not provided, it is not served")
+			continue
+		}
+
+		if !json.Valid([]byte(raw)) {
+			return nil, errors.Errorf("%s is not valid json", key)
+		}
+		*document = json.RawMessage(raw)
+	}
+
+	return k, nil
+}
+
+// AppleAppSiteAssociation serves the apple-app-site-association document
+func (k *WellKnown) AppleAppSiteAssociation(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, k.appleAppSiteAssociation)
+}
+
+// AssetLinks serves the Digital Asset Links of the Android apps
+func (k *WellKnown) AssetLinks(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, k.assetLinks)
+}
+
+func serveDocument(w http.ResponseWriter, r *http.Request, document json.RawMessage) {
+	if len(document) == 0 {
+		NotFound(w, r)
+		return
+	}
+
+	render.JSON(w, r, document)
+}
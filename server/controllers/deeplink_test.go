@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/danielnguyentb/url-shortener/core"
+	"github.com/danielnguyentb/url-shortener/libs"
+)
+
+func TestWellKnown(t *testing.T) {
+	log := libs.InitLogging()
+	defer viper.Set(keyWellKnownAppleAppSiteAssociation, "")
+
+	log.Debug("Invalid documents are refused")
+	viper.Set(keyWellKnownAppleAppSiteAssociation, `{"applinks":`)
+	_, err := NewWellKnownController(log)
+	assert.Error(t, err)
+
+	log.Debug("Configured documents are served as json, the others are not found")
+	viper.Set(keyWellKnownAppleAppSiteAssociation, `{"applinks": {"apps": [], "details": [{"appID": "TEAMID.com.example.app", "paths": ["/r/*"]}]}}`)
+	wellKnown, err := NewWellKnownController(log)
+	require.NoError(t, err)
+
+	r := core.NewRouter()
+	r.Get("/.well-known/apple-app-site-association", wellKnown.AppleAppSiteAssociation)
+	r.Get("/.well-known/assetlinks.json", wellKnown.AssetLinks)
+
+	req, _ := http.NewRequest("GET", "/.well-known/apple-app-site-association", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"applinks": {"apps": [], "details": [{"appID": "TEAMID.com.example.app", "paths": ["/r/*"]}]}}`, w.Body.String())
+
+	req, _ = http.NewRequest("GET", "/.well-known/assetlinks.json", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	keyApiKeys      = "apiKeys"
+	keyApiKeyHeader = "X-Api-Key"
+)
+
+var (
+	ErrInvalidApiKey  = errors.New("Invalid api key")
+	ErrApiKeyRequired = errors.New("Api key is required")
+)
+
+// ApiKey grants the links created with it to an owner
+type ApiKey struct {
+	Key   string `mapstructure:"key" json:"key"`
+	Owner string `mapstructure:"owner" json:"owner"`
+}
+
+// apiKeys reads the api keys of the config, or the json list of the
+// APIKEYS environment variable
+func apiKeys() ([]ApiKey, error) {
+	var keys []ApiKey
+	if raw, ok := viper.Get(keyApiKeys).(string); ok {
+		if len(strings.TrimSpace(raw)) == 0 {
+			return nil, nil
+		}
+
+		if err := json.Unmarshal([]byte(raw), &keys); err != nil {
+			return nil, errors.Wrap(err, "json.Unmarshal")
+		}
+
+		return keys, nil
+	}
+
+	if err := viper.UnmarshalKey(keyApiKeys, &keys); err != nil {
+		return nil, errors.Wrap(err, "viper.UnmarshalKey")
+	}
+
+	return keys, nil
+}
+
+// ownerFromRequest resolves the owner of the api key sent with the request.
+// Requests without api key are anonymous and have an empty owner.
+func ownerFromRequest(r *http.Request) (string, error) {
+	sent := r.Header.Get(keyApiKeyHeader)
+	if len(sent) == 0 {
+		return "", nil
+	}
+
+	keys, err := apiKeys()
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range keys {
+		if len(key.Key) != 0 && len(key.Owner) != 0 &&
+			subtle.ConstantTimeCompare([]byte(key.Key), []byte(sent)) == 1 {
+			return key.Owner, nil
+		}
+	}
+
+	return "", ErrInvalidApiKey
+}
+
+// ApiClient reports whether a request carries a valid api key. API clients
+// skip CSRF, a cross-site page can't send a key it doesn't know.
+func ApiClient(r *http.Request) bool {
+	owner, err := ownerFromRequest(r)
+	return err == nil && len(owner) != 0
+}
@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApiKeysFromEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("APIKEYS", `[{"key": "env-key", "owner": "sales"}]`))
+	defer os.Unsetenv("APIKEYS")
+	viper.AutomaticEnv()
+
+	req, _ := http.NewRequest("GET", "/links/abc", nil)
+	req.Header.Set(keyApiKeyHeader, "env-key")
+	owner, err := ownerFromRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "sales", owner)
+
+	req.Header.Set(keyApiKeyHeader, "other-key")
+	_, err = ownerFromRequest(req)
+	assert.ErrorIs(t, err, ErrInvalidApiKey)
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/middlewares"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyLinkPasswordHeader carries the password of protected links for api clients
+	keyLinkPasswordHeader = "X-Link-Password"
+	passwordFieldName     = "password"
+)
+
+// PasswordPage is the data of the password prompt of protected links
+type PasswordPage struct {
+	CSRFToken string
+	Code      string
+	Message   string
+}
+
+// passwordForm reports whether a request submits the password prompt
+func passwordForm(r *http.Request) bool {
+	return r.Method == http.MethodPost && len(r.PostFormValue(passwordFieldName)) != 0
+}
+
+// RedirectCSRFExempt reports whether a post to a short link skips CSRF.
+// Posts are redirected without changing anything, only those sending a
+// password are protected, unless they come from an api client.
+func RedirectCSRFExempt(r *http.Request) bool {
+	if !passwordForm(r) && len(r.Header.Get(keyLinkPasswordHeader)) == 0 {
+		return true
+	}
+
+	return ApiClient(r)
+}
+
+// unlock checks the password of protected items, it reports whether the
+// visitor can be redirected. Browsers are prompted with a form, other
+// clients send the password in a header.
+func (u *Url) unlock(w http.ResponseWriter, r *http.Request, log *zap.Logger, item *models.Url) bool {
+	if !item.Protected {
+		return true
+	}
+
+	password := r.Header.Get(keyLinkPasswordHeader)
+	if r.Method == http.MethodPost && len(r.PostFormValue(passwordFieldName)) != 0 {
+		password = r.PostFormValue(passwordFieldName)
+	}
+
+	err := u.model.CheckPassword(item, password)
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, models.ErrPasswordRequired):
+		status = http.StatusUnauthorized
+	case errors.Is(err, models.ErrPasswordInvalid):
+		status = http.StatusForbidden
+	case errors.Is(err, models.ErrTooManyAttempts):
+		status = http.StatusTooManyRequests
+	default:
+		log.With(zap.Error(err)).Error("fail to check password")
+	}
+
+	render.Status(r, status)
+	if !wantsHTML(r) && r.Method != http.MethodPost {
+		render.JSON(w, r, Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return false
+	}
+
+	page := PasswordPage{Code: item.Key}
+	if !errors.Is(err, models.ErrPasswordRequired) {
+		page.Message = err.Error()
+	}
+
+	// The form is protected like every other form
+	middlewares.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page.CSRFToken = middlewares.CSRFToken(r)
+		render.HTML(w, r, "password", page)
+	})).ServeHTTP(w, r)
+
+	return false
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/core"
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyPreviewAlways shows the preview page before the redirects of every link
+	keyPreviewAlways = "preview.always"
+	// keyPreviewDomains shows the preview page before the redirects to these
+	// domains and their subdomains
+	keyPreviewDomains = "preview.domains"
+
+	// previewSuffix appended to a short code previews the link, like /r/abc+
+	previewSuffix = "+"
+)
+
+// PreviewPage describes where a link goes without following it. The
+// destination of protected links and of links not available is kept hidden.
+type PreviewPage struct {
+	Code      string    `json:"code"`
+	Origin    string    `json:"origin,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Protected bool      `json:"protected"`
+	// State is the lifecycle state of the link, Warning explains why it may be unsafe
+	State   string `json:"state"`
+	Warning string `json:"warning,omitempty"`
+	// Available links can be followed from the preview
+	Available     bool   `json:"available"`
+	ContinueParam string `json:"-"`
+}
+
+// Preview renders the preview page of a link, JSON for the other clients.
+// Hits are not counted.
+func (u *Url) Preview(w http.ResponseWriter, r *http.Request) {
+	shortenCode, _ := previewCode(core.RouteContext(r.Context()).RouteParams.Get("code"))
+	u.preview(w, r, shortenCode)
+}
+
+// previewCode returns the code of a preview request like /r/abc+. Route
+// params are unescaped like queries, the plus comes as a space unless it was
+// escaped.
+func previewCode(code string) (string, bool) {
+	for _, suffix := range []string{" ", previewSuffix} {
+		if strings.HasSuffix(code, suffix) {
+			return strings.TrimSuffix(code, suffix), true
+		}
+	}
+
+	return code, false
+}
+
+func (u *Url) preview(w http.ResponseWriter, r *http.Request, shortenCode string) {
+	log := libs.GetLogEntry(r).With(zap.String("code", shortenCode))
+
+	item, err := u.model.FindByShortCode(shortenCode, false)
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrNotFound):
+		NotFound(w, r)
+		return
+	case unavailable(w, r, err):
+		return
+	case !errors.Is(err, models.ErrFlagged) && !errors.Is(err, models.ErrExpired) && !errors.Is(err, models.ErrNotActive):
+		log.With(zap.Error(err)).Error("fail to look up url with short code")
+		render.Status(r, http.StatusBadRequest)
+		render.NoContent(w, r)
+		return
+	}
+
+	previewPage(w, r, item)
+}
+
+// previewPage renders the preview of a link, JSON for the clients which are
+// not browsers
+func previewPage(w http.ResponseWriter, r *http.Request, item *models.Url) {
+	page := newPreviewPage(item)
+	if !wantsHTML(r) {
+		render.JSON(w, r, page)
+		return
+	}
+
+	render.HTML(w, r, "preview", page)
+}
+
+// newPreviewPage describes a link for its preview
+func newPreviewPage(item *models.Url) PreviewPage {
+	state := item.Evaluate(time.Now())
+	page := PreviewPage{
+		Code:          item.Key,
+		CreatedAt:     item.CreatedAt,
+		Protected:     item.Protected,
+		State:         string(state),
+		Available:     state == models.StateActive || state == models.StateFlagged,
+		ContinueParam: continueParam,
+	}
+
+	// Scheduled links hide their destination behind the pre-launch url,
+	// expired and deleted links must not leak it either
+	if !page.Available {
+		return page
+	}
+
+	if !item.Protected {
+		page.Origin, page.Title = item.Origin, item.Title
+	}
+
+	switch {
+	case state == models.StateFlagged && len(item.StateReason) != 0:
+		page.Warning = "This link has been flagged: " + item.StateReason
+	case state == models.StateFlagged:
+		page.Warning = "This link has been flagged"
+	case flaggedDomain(item.Origin):
+		page.Warning = "The destination domain has been flagged"
+	}
+
+	return page
+}
+
+// interstitial reports whether a link shows its preview before redirecting
+func interstitial(item *models.Url) bool {
+	return item.Interstitial || viper.GetBool(keyPreviewAlways) || flaggedDomain(item.Origin)
+}
+
+// flaggedDomain reports whether a destination is on a domain always previewed
+func flaggedDomain(origin string) bool {
+	domains := viper.GetStringSlice(keyPreviewDomains)
+	if len(domains) == 0 {
+		return false
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return models.MatchDomain(domains, strings.ToLower(parsed.Hostname()))
+}
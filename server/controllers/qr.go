@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // Logos can be jpeg
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/core"
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyQrCacheTTL is how long rendered QR codes are cached, by parameters
+	keyQrCacheTTL = "qr.cacheTTL"
+	// keyQrCacheEntries bounds the renders cached for each link, other
+	// parameters are rendered on every request
+	keyQrCacheEntries = "qr.cacheEntries"
+	// keyQrLogo is the png or jpeg image drawn over the codes asking for it
+	keyQrLogo = "qr.logo"
+
+	// sourceParam marks the redirects scanned from a QR code, it is dropped
+	// from the query passed through to the destination
+	sourceParam = "src"
+	sourceQr    = "qr"
+
+	qrFormatPng = "png"
+	qrFormatSvg = "svg"
+
+	defaultQrSize   = 256
+	defaultQrMargin = 4
+	maxQrSize       = 1024
+	// qrLogoRatio is the share of the code width covered by the logo, the
+	// highest recovery level restores the modules under it
+	qrLogoRatio = 5
+)
+
+// qrSizes are the widths QR codes are rendered at, requested sizes are
+// rounded up to one of them so few renders are cached
+var qrSizes = []int{128, 256, 512, maxQrSize}
+
+// qrCacheScript caches a render in the hash of a link unless it holds enough
+// renders already. The hash expires with its first render.
+var qrCacheScript = redis.NewScript(`
+if redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[3]) and redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+// qrLevels are the error correction levels by their letter
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// QrRequest are the rendering parameters of a QR code
+type QrRequest struct {
+	Format string `valid:"in(png|svg),optional" json:"format,omitempty"`
+	// Size is the width of the image in pixels, rounded up to one of qrSizes
+	Size int    `valid:"optional,range(64|1024)" json:"size,omitempty"`
+	Ecc  string `valid:"in(L|M|Q|H),optional" json:"ecc,omitempty"`
+	// Margin is the quiet zone around the code, in modules
+	Margin *int `valid:"optional,range(0|8)" json:"margin,omitempty"`
+	Logo   bool `valid:"optional" json:"logo,omitempty"`
+}
+
+// qrLogo is the logo drawn over the codes, kept encoded for the svg codes
+type qrLogo struct {
+	image image.Image
+	png   []byte
+}
+
+func init() {
+	viper.SetDefault(keyQrCacheTTL, 24*time.Hour)
+	viper.SetDefault(keyQrCacheEntries, 16)
+}
+
+// newQrLogo loads the configured logo, nil when there is none
+func newQrLogo(log *zap.Logger) (*qrLogo, error) {
+	path := viper.GetString(keyQrLogo)
+	if len(path) == 0 {
+		log.Info(keyQrLogo + " is not provided, QR codes have no logo")
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.Open")
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "image.Decode")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, errors.Wrap(err, "png.Encode")
+	}
+
+	return &qrLogo{image: img, png: buf.Bytes()}, nil
+}
+
+// QrCode renders the QR code of the short url of a link. The url carries the
+// QR source so that scans are told apart in the clicks.
+func (u *Url) QrCode(w http.ResponseWriter, r *http.Request) {
+	log := libs.GetLogEntry(r)
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	req := &QrRequest{}
+	if err := render.Bind(r, req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Response{
+			Success: false,
+			Message: err.Error(),
+			Errors:  render.FieldErrors(err),
+		})
+		return
+	}
+	req.defaults()
+
+	if req.Logo && u.logo == nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Response{
+			Success: false,
+			Message: "no logo is configured",
+		})
+		return
+	}
+
+	// Scheduled, flagged and expired links keep their code, removed links lose it
+	item, err := u.model.FindByShortCode(shortenCode, false)
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrNotFound):
+		NotFound(w, r)
+		return
+	case unavailable(w, r, err):
+		return
+	case !errors.Is(err, models.ErrFlagged) && !errors.Is(err, models.ErrExpired) && !errors.Is(err, models.ErrNotActive):
+		log.With(zap.Error(err)).Error("fail to look up url with short code")
+		render.Status(r, http.StatusBadRequest)
+		render.NoContent(w, r)
+		return
+	}
+
+	ctx := context.Background()
+	ttl := viper.GetDuration(keyQrCacheTTL)
+	key, field := models.QrCacheKey(item.Key), req.cacheField()
+	body, err := u.redis.HGet(ctx, key, field).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.With(zap.Error(err)).Error("fail to read cached QR code")
+		}
+
+		content := strings.Join([]string{shortenUrl(item.Key), "?", sourceParam, "=", sourceQr}, "")
+		body, err = req.render(content, u.logo)
+		if err != nil {
+			log.With(zap.Error(err)).Error("fail to render QR code")
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, Response{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		args := []interface{}{field, body, viper.GetInt(keyQrCacheEntries), ttl.Milliseconds()}
+		if err := qrCacheScript.Run(ctx, u.redis, []string{key}, args...).Err(); err != nil {
+			log.With(zap.Error(err)).Error("fail to cache QR code")
+		}
+	}
+
+	contentType := "image/png"
+	if req.Format == qrFormatSvg {
+		contentType = "image/svg+xml"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+	if _, err := w.Write(body); err != nil {
+		log.With(zap.Error(err)).Error("fail to write QR code")
+	}
+}
+
+// defaults fills the parameters left out, the logo needs the highest level
+func (req *QrRequest) defaults() {
+	if len(req.Format) == 0 {
+		req.Format = qrFormatPng
+	}
+
+	if req.Size == 0 {
+		req.Size = defaultQrSize
+	}
+	for _, size := range qrSizes {
+		if req.Size <= size {
+			req.Size = size
+			break
+		}
+	}
+
+	if len(req.Ecc) == 0 {
+		req.Ecc = "M"
+	}
+
+	if req.Logo {
+		req.Ecc = "H"
+	}
+
+	if req.Margin == nil {
+		margin := defaultQrMargin
+		req.Margin = &margin
+	}
+}
+
+func (req *QrRequest) cacheField() string {
+	return strings.Join([]string{
+		req.Format, strconv.Itoa(req.Size), req.Ecc, strconv.Itoa(*req.Margin), strconv.FormatBool(req.Logo),
+	}, "-")
+}
+
+// render draws the QR code of a content in the requested format
+func (req *QrRequest) render(content string, logo *qrLogo) ([]byte, error) {
+	code, err := qrcode.New(content, qrLevels[req.Ecc])
+	if err != nil {
+		return nil, errors.Wrap(err, "qrcode.New")
+	}
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	if !req.Logo {
+		logo = nil
+	}
+
+	if req.Format == qrFormatSvg {
+		return req.svg(modules, logo), nil
+	}
+
+	return req.png(modules, logo)
+}
+
+// png draws the modules with whole pixels, centered in the requested size
+func (req *QrRequest) png(modules [][]bool, logo *qrLogo) ([]byte, error) {
+	width := len(modules) + 2**req.Margin
+	scale := req.Size / width
+	if scale == 0 {
+		return nil, errors.Errorf("size %d is too small for %d modules", req.Size, width)
+	}
+	offset := (req.Size-scale*width)/2 + scale**req.Margin
+
+	img := image.NewRGBA(image.Rect(0, 0, req.Size, req.Size))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			module := image.Rect(offset+x*scale, offset+y*scale, offset+(x+1)*scale, offset+(y+1)*scale)
+			draw.Draw(img, module, image.Black, image.Point{}, draw.Src)
+		}
+	}
+
+	if logo != nil {
+		side := scale * len(modules) / qrLogoRatio
+		origin := (req.Size - side) / 2
+		drawScaled(img, image.Rect(origin, origin, origin+side, origin+side), logo.image)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, errors.Wrap(err, "png.Encode")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// svg draws the modules as one path, the image scales to any size
+func (req *QrRequest) svg(modules [][]bool, logo *qrLogo) []byte {
+	width := len(modules) + 2**req.Margin
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		req.Size, req.Size, width, width)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, width)
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(buf, "M%d %dh1v1h-1z", x+*req.Margin, y+*req.Margin)
+			}
+		}
+	}
+	buf.WriteString(`"/>`)
+
+	if logo != nil {
+		side := float64(len(modules)) / qrLogoRatio
+		origin := (float64(width) - side) / 2
+		fmt.Fprintf(buf, `<image x="%g" y="%g" width="%g" height="%g" href="data:image/png;base64,%s"/>`,
+			origin, origin, side, side, base64.StdEncoding.EncodeToString(logo.png))
+	}
+	buf.WriteString(`</svg>`)
+
+	return buf.Bytes()
+}
+
+// drawScaled draws an image into a rectangle, by nearest neighbour
+func drawScaled(dst *image.RGBA, rect image.Rectangle, src image.Image) {
+	bounds := src.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			sx := bounds.Min.X + (x-rect.Min.X)*bounds.Dx()/rect.Dx()
+			sy := bounds.Min.Y + (y-rect.Min.Y)*bounds.Dy()/rect.Dy()
+			// Colors are premultiplied, logos are drawn over a white background
+			r, g, b, a := src.At(sx, sy).RGBA()
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r + 0xffff - a),
+				G: uint16(g + 0xffff - a),
+				B: uint16(b + 0xffff - a),
+				A: 0xffff,
+			})
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mssola/user_agent"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+// RuleRequest is a redirect rule of a link, visitors matching every
+// condition are sent to its target. Times use the format of Expire.
+type RuleRequest struct {
+	Name      string   `valid:"optional,length(0|64)" json:"name,omitempty"`
+	Countries []string `valid:"optional" json:"countries,omitempty"`
+	OS        []string `valid:"optional" json:"os,omitempty"`
+	Devices   []string `valid:"optional" json:"devices,omitempty"`
+	Languages []string `valid:"optional" json:"languages,omitempty"`
+	Referrers []string `valid:"optional" json:"referrers,omitempty"`
+	After     string   `valid:"time,optional" json:"after,omitempty"`
+	Before    string   `valid:"time,optional" json:"before,omitempty"`
+	Target    string   `valid:"required,url" json:"target"`
+}
+
+// redirectRules converts the requested rules
+func redirectRules(reqs []RuleRequest) models.RedirectRules {
+	var rules models.RedirectRules
+	for _, req := range reqs {
+		rules = append(rules, models.RedirectRule{
+			Name:      req.Name,
+			Countries: req.Countries,
+			OS:        req.OS,
+			Devices:   req.Devices,
+			Languages: req.Languages,
+			Referrers: req.Referrers,
+			After:     parseRuleTime(req.After),
+			Before:    parseRuleTime(req.Before),
+			Target:    req.Target,
+		})
+	}
+
+	return rules
+}
+
+// appleMobiles are the platforms of the user agents running iOS, reported
+// under several operating system names
+var appleMobiles = map[string]bool{
+	"iPhone": true,
+	"iPad":   true,
+	"iPod":   true,
+}
+
+// newVisitor describes a request for the rules from its click event
+func newVisitor(r *http.Request, event models.ClickEvent) models.Visitor {
+	os := event.OS
+	if appleMobiles[user_agent.New(r.UserAgent()).Platform()] {
+		os = "iOS"
+	}
+
+	return models.Visitor{
+		Country:        event.Country,
+		OS:             os,
+		Device:         event.Device,
+		AcceptLanguage: r.Header.Get("Accept-Language"),
+		Referrer:       event.Referrer,
+		Time:           time.Now(),
+		Key:            strings.Join([]string{clientIP(r).String(), r.UserAgent()}, "|"),
+		Variant:        assignedVariant(r, event.Code),
+	}
+}
+
+// parseRuleTime parses a time of a rule, nil when it is not set
+func parseRuleTime(value string) *time.Time {
+	if len(value) == 0 {
+		return nil
+	}
+
+	parsed, _ := time.Parse(libs.TimeFormat, value)
+	return &parsed
+}
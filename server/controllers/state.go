@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+// continueParam confirms the redirect of a flagged link
+const continueParam = "continue"
+
+// UnavailablePage is the data of the page of a link removed by moderation
+type UnavailablePage struct {
+	Title   string
+	Message string
+}
+
+// WarningPage is the data of the page shown before following a flagged link
+type WarningPage struct {
+	Code          string
+	Origin        string
+	Reason        string
+	ContinueParam string
+}
+
+// stateResponses answer the redirects of the links held or removed by
+// moderation, each with its own status
+var stateResponses = []struct {
+	err    error
+	status int
+	page   UnavailablePage
+}{
+	{models.ErrPendingReview, http.StatusForbidden, UnavailablePage{
+		Title:   "Link is awaiting review",
+		Message: "This link is checked by a moderator before it can be used.",
+	}},
+	{models.ErrDisabled, http.StatusForbidden, UnavailablePage{
+		Title:   "Link is disabled",
+		Message: "This link was disabled by an administrator.",
+	}},
+	{models.ErrBanned, http.StatusGone, UnavailablePage{
+		Title:   "Link was removed",
+		Message: "This link was removed for violating the terms of use.",
+	}},
+	{models.ErrTakenDown, http.StatusUnavailableForLegalReasons, UnavailablePage{
+		Title:   "Link is unavailable for legal reasons",
+		Message: "This link was removed following a legal request.",
+	}},
+}
+
+// unavailable answers the redirect of a link held or removed by moderation,
+// reporting whether the error was one of those
+func unavailable(w http.ResponseWriter, r *http.Request, err error) bool {
+	for _, response := range stateResponses {
+		if !errors.Is(err, response.err) {
+			continue
+		}
+
+		render.Status(r, response.status)
+		if wantsHTML(r) {
+			render.HTML(w, r, "unavailable", response.page)
+			return true
+		}
+
+		render.NoContent(w, r)
+		return true
+	}
+
+	return false
+}
+
+// confirmed reports whether the visitor chose to follow a flagged link, the
+// password form is only shown once they did
+func confirmed(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.URL.Query().Get(continueParam) == "1"
+}
+
+// warning renders the page shown before following a flagged link, the other
+// clients get its preview with the warning
+func warning(w http.ResponseWriter, r *http.Request, item *models.Url) {
+	if !wantsHTML(r) {
+		previewPage(w, r, item)
+		return
+	}
+
+	render.HTML(w, r, "warning", WarningPage{
+		Code:          item.Key,
+		Origin:        item.Origin,
+		Reason:        item.StateReason,
+		ContinueParam: continueParam,
+	})
+}
@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/core"
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	keyIfMatchHeader = "If-Match"
+	keyETagHeader    = "ETag"
+)
+
+var (
+	ErrInvalidIfMatch = errors.New("If-Match does not match a version")
+)
+
+// UpdateRequest holds the fields of a link to change, the fields left out are
+// unchanged. Empty times clear the expire or activation time.
+type UpdateRequest struct {
+	Url          *string `valid:"url,optional" json:"url,omitempty"`
+	Expire       *string `valid:"time,optional" json:"expire,omitempty"`
+	ActiveFrom   *string `valid:"time,optional" json:"active_from,omitempty"`
+	PrelaunchUrl *string `valid:"url,optional" json:"prelaunch_url,omitempty"`
+	Status       *bool   `valid:"optional" json:"status,omitempty"`
+	// State moves the link to a moderation state, owners only delete and restore
+	State            *string `valid:"in(active|pending_review|flagged|disabled|deleted|banned|takedown),optional" json:"state,omitempty"`
+	RedirectType     *string `valid:"in(301|302|307|308|meta|js),optional" json:"redirect_type,omitempty"`
+	QueryPassthrough *string `valid:"in(none|preserve|override),optional" json:"query_passthrough,omitempty"`
+	// Utm replaces every UTM parameter of the link
+	Utm *UtmRequest `valid:"optional" json:"utm,omitempty"`
+	// Rules replaces every rule of the link, an empty list removes them
+	Rules *[]RuleRequest `valid:"optional" json:"rules,omitempty"`
+	// Variants replaces every variant of the link, an empty list removes them
+	Variants  *[]VariantRequest `valid:"optional" json:"variants,omitempty"`
+	SplitMode *string           `valid:"in(random|hash),optional" json:"split_mode,omitempty"`
+	// DeepLink replaces every deep link setting of the link
+	DeepLink     *DeepLinkRequest `valid:"optional" json:"deep_link,omitempty"`
+	Title        *string          `valid:"optional,length(0|255)" json:"title,omitempty"`
+	Interstitial *bool            `valid:"optional" json:"interstitial,omitempty"`
+	// Reason is recorded in the history of the link
+	Reason string `valid:"optional,length(0|255)" json:"reason,omitempty"`
+}
+
+type LinkResponse struct {
+	Success bool                `json:"success"`
+	Message string              `json:"message,omitempty"`
+	Errors  []render.FieldError `json:"errors,omitempty"`
+	Item    *models.Url         `json:"item,omitempty"`
+}
+
+// GetLink responds with a link of the api key owner and its ETag
+func (u *Url) GetLink(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	getLink(w, r, u.model, owner)
+}
+
+// UpdateLink changes a link of the api key owner
+func (u *Url) UpdateLink(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	updateLink(w, r, u.model, owner, owner)
+}
+
+// requireOwner resolves the owner of the api key, anonymous requests are
+// unauthorized
+func requireOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner, err := ownerFromRequest(r)
+	if err == nil && len(owner) == 0 {
+		err = ErrApiKeyRequired
+	}
+	if err != nil {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return "", false
+	}
+
+	return owner, true
+}
+
+func getLink(w http.ResponseWriter, r *http.Request, model *models.UrlModel, owner string) {
+	log := libs.GetLogEntry(r)
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+
+	item, err := model.Get(shortenCode, owner)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			render.Status(r, http.StatusNotFound)
+			render.NoContent(w, r)
+			return
+		}
+
+		log.With(zap.Error(err), zap.String("code", shortenCode)).Error("fail to get link")
+		render.Status(r, http.StatusBadGateway)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+		})
+		return
+	}
+
+	w.Header().Set(keyETagHeader, item.ETag())
+	render.JSON(w, r, LinkResponse{
+		Success: true,
+		Item:    item,
+	})
+}
+
+// updateLink changes a link of an owner, or any link with an empty owner.
+// Changes go through the validation of created links, a version sent with
+// If-Match makes the update fail if the link changed meanwhile.
+func updateLink(w http.ResponseWriter, r *http.Request, model *models.UrlModel, owner, actor string) {
+	log := libs.GetLogEntry(r)
+	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
+	log = log.With(zap.String("code", shortenCode))
+
+	version, err := parseIfMatch(r.Header.Get(keyIfMatchHeader))
+	if err != nil {
+		render.Status(r, http.StatusPreconditionFailed)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	req := &UpdateRequest{}
+	if err := render.Bind(r, req); err != nil {
+		log.Info("update request invalid", zap.Error(err))
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+			Errors:  render.FieldErrors(err),
+		})
+		return
+	}
+
+	changes := models.UrlChanges{
+		Origin:           req.Url,
+		Expire:           parseOptionalTime(req.Expire),
+		ActiveFrom:       parseOptionalTime(req.ActiveFrom),
+		PrelaunchUrl:     req.PrelaunchUrl,
+		Status:           req.Status,
+		State:            (*models.LinkState)(req.State),
+		RedirectType:     req.RedirectType,
+		QueryPassthrough: req.QueryPassthrough,
+		SplitMode:        req.SplitMode,
+		Title:            req.Title,
+		Interstitial:     req.Interstitial,
+		Actor:            actor,
+		Reason:           req.Reason,
+	}
+	if req.Utm != nil {
+		utm := req.Utm.params()
+		changes.Utm = &utm
+	}
+	if req.Rules != nil {
+		rules := redirectRules(*req.Rules)
+		changes.Rules = &rules
+	}
+	if req.Variants != nil {
+		variants := splitVariants(*req.Variants)
+		changes.Variants = &variants
+	}
+	if req.DeepLink != nil {
+		deepLink := req.DeepLink.deepLink()
+		changes.DeepLink = &deepLink
+	}
+	if err := checkBlacklist(log, changes.Targets()...); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	item, err := model.Update(shortenCode, owner, version, changes)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, models.ErrVersionConflict):
+			status = http.StatusPreconditionFailed
+		case errors.Is(err, models.ErrInvalidTransition):
+			status = http.StatusConflict
+		}
+
+		log.With(zap.Error(err)).Info("fail to update link")
+		render.Status(r, status)
+		render.JSON(w, r, LinkResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.With(zap.Uint("version", item.Version)).Info("Shorten url updated")
+	w.Header().Set(keyETagHeader, item.ETag())
+	render.JSON(w, r, LinkResponse{
+		Success: true,
+		Item:    item,
+	})
+}
+
+// hasRequestBody reports whether the request carries a body to bind
+func hasRequestBody(r *http.Request) bool {
+	return r.ContentLength > 0 || len(r.Header.Get("Content-Type")) != 0
+}
+
+// parseIfMatch returns the version of the If-Match header, 0 when any
+// version matches
+func parseIfMatch(header string) (uint, error) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 || header == "*" {
+		return 0, nil
+	}
+
+	// Versions are strong tags, weak ones never match
+	unquoted, err := strconv.Unquote(header)
+	if err != nil {
+		return 0, ErrInvalidIfMatch
+	}
+
+	version, err := strconv.ParseUint(unquoted, 10, 32)
+	if err != nil || version == 0 {
+		return 0, ErrInvalidIfMatch
+	}
+
+	return uint(version), nil
+}
+
+// parseOptionalTime parses a validated time, an empty one is the zero time
+func parseOptionalTime(value *string) *time.Time {
+	if value == nil {
+		return nil
+	}
+
+	parsed := time.Time{}
+	if len(*value) != 0 {
+		parsed, _ = time.Parse(libs.TimeFormat, *value)
+	}
+
+	return &parsed
+}
@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"context"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,105 +24,283 @@ import (
 const (
 	errorOccurred = "Error Occurred"
 	keyBlacklist  = "blacklistUrls"
+	// keyScheduledStatus is the status of the redirects before a link is active
+	keyScheduledStatus = "scheduled.status"
+	// keyScheduledUrl is the pre-launch url of the links without their own
+	keyScheduledUrl = "scheduled.url"
+	// keyPermanentMaxAge is how long browsers may cache permanent redirects,
+	// edits, expiry, rules and clicks of the link are missed meanwhile
+	keyPermanentMaxAge = "redirect.permanentMaxAge"
+)
+
+var (
+	ErrBlacklisted = errors.New("Url is in blacklists")
 )
 
 type Request struct {
 	Url    string `valid:"required,url" json:"url"`
 	Expire string `valid:"time,optional" json:"expire,omitempty"`
+	// ActiveFrom is the time the link starts redirecting, PrelaunchUrl is used before
+	ActiveFrom   string `valid:"time,optional" json:"active_from,omitempty"`
+	PrelaunchUrl string `valid:"url,optional" json:"prelaunch_url,omitempty"`
+	Alias        string `valid:"alias,optional" json:"alias,omitempty"`
+	// Dedupe reuses an active link to the same destination with the same settings
+	Dedupe bool `valid:"optional" json:"dedupe,omitempty"`
+	// Password protects the link, visitors are asked for it
+	Password string `valid:"optional,length(4|72)" json:"password,omitempty"`
+	// MaxClicks makes the link gone after that many redirects, 1 for one-time links
+	MaxClicks uint `valid:"optional" json:"max_clicks,omitempty"`
+	// RedirectType is the status of the redirect, or a meta refresh or script page
+	RedirectType string `valid:"in(301|302|307|308|meta|js),optional" json:"redirect_type,omitempty"`
+	// QueryPassthrough merges the query of the visitors into the destination
+	QueryPassthrough string      `valid:"in(none|preserve|override),optional" json:"query_passthrough,omitempty"`
+	Utm              *UtmRequest `valid:"optional" json:"utm,omitempty"`
+	// Rules are evaluated in order, visitors matching none go to Url
+	Rules []RuleRequest `valid:"optional" json:"rules,omitempty"`
+	// Variants split the visitors matching no rule, SplitMode hash assigns
+	// them without cookie
+	Variants  []VariantRequest `valid:"optional" json:"variants,omitempty"`
+	SplitMode string           `valid:"in(random|hash),optional" json:"split_mode,omitempty"`
+	// DeepLink opens the app of the link on mobiles, the others go to Url
+	DeepLink *DeepLinkRequest `valid:"optional" json:"deep_link,omitempty"`
+	// Title is shown on the preview page, Interstitial shows it before every redirect
+	Title        string `valid:"optional,length(0|255)" json:"title,omitempty"`
+	Interstitial bool   `valid:"optional" json:"interstitial,omitempty"`
+}
+
+// UtmRequest holds the UTM parameters added to the destination of a link
+type UtmRequest struct {
+	Source   string `valid:"optional,length(0|255)" json:"source,omitempty"`
+	Medium   string `valid:"optional,length(0|255)" json:"medium,omitempty"`
+	Campaign string `valid:"optional,length(0|255)" json:"campaign,omitempty"`
+	Term     string `valid:"optional,length(0|255)" json:"term,omitempty"`
+	Content  string `valid:"optional,length(0|255)" json:"content,omitempty"`
+}
+
+// RefreshPage is the data of the page redirecting with a meta refresh or a script
+type RefreshPage struct {
+	Url    string
+	Script bool
 }
 
 type Response struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	ShortenUrl  string `json:"shorten_url"`
-	ShortenCode string `json:"shorten_code"`
+	Success     bool                `json:"success"`
+	Message     string              `json:"message"`
+	Errors      []render.FieldError `json:"errors,omitempty"`
+	ShortenUrl  string              `json:"shorten_url"`
+	ShortenCode string              `json:"shorten_code"`
+	Reused      bool                `json:"reused"`
 }
 
 type Url struct {
-	model *models.UrlModel
+	model  *models.UrlModel
+	clicks *models.ClickWriter
+	geo    locator
+	bots   *BotDetector
+	redis  *redis.Client
+	logo   *qrLogo
+}
+
+func init() {
+	viper.SetDefault(keyScheduledStatus, http.StatusNotFound)
+	viper.SetDefault(keyPermanentMaxAge, 5*time.Minute)
+
+	render.RegisterValidator("time", func(str string) bool {
+		if len(str) == 0 {
+			return true
+		}
+
+		return govalidator.IsTime(str, libs.TimeFormat)
+	})
+	render.RegisterValidator("alias", models.ValidAlias)
 }
 
 func (u *Url) CreateShorten(w http.ResponseWriter, r *http.Request) {
-	log, req, err := u.parseRequestAndValidate(r)
-	if err != nil {
+	log := libs.GetLogEntry(r)
+	req := &Request{}
+	if err := render.Bind(r, req); err != nil {
+		log.Error("request invalid", zap.Error(err))
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, Response{
 			Success: false,
 			Message: err.Error(),
+			Errors:  render.FieldErrors(err),
 		})
 		return
 	}
 
-	// Check black list url
-	blackLists := viper.GetStringSlice(keyBlacklist)
-	for _, blacklist := range blackLists {
-		matched, err := regexp.Match(regexp.QuoteMeta(blacklist), []byte(req.Url))
-		if err != nil {
-			log.With(zap.String("blacklist_pattern", blacklist)).Error("failed to matching")
-		}
+	owner, err := ownerFromRequest(r)
+	if err != nil {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
 
-		if matched {
-			render.Status(r, http.StatusBadRequest)
-			render.JSON(w, r, Response{
-				Success: false,
-				Message: "Url is in blacklists",
-			})
-		}
+	item, reused, status, err := u.shorten(log, req, owner)
+	if err != nil {
+		render.Status(r, status)
+		render.JSON(w, r, Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
 	}
 
+	render.JSON(w, r, Response{
+		Success:     true,
+		ShortenUrl:  shortenUrl(item.Key),
+		ShortenCode: item.Key,
+		Reused:      reused,
+	})
+}
+
+// shorten checks the requested url against the blacklist and generates a new
+// shorten item, or reuses an existing one when dedupe is requested. On failure
+// it also returns the matching HTTP status.
+func (u *Url) shorten(log *zap.Logger, req *Request, owner string) (*models.Url, bool, int, error) {
+	log = log.With(zap.String("url", req.Url), zap.String("expire", req.Expire), zap.String("alias", req.Alias))
+
 	var expire *time.Time
 	if len(req.Expire) != 0 {
 		expireTime, _ := time.Parse(libs.TimeFormat, req.Expire)
 		expire = &expireTime
 	}
 
+	var activeFrom *time.Time
+	if len(req.ActiveFrom) != 0 {
+		activeTime, _ := time.Parse(libs.TimeFormat, req.ActiveFrom)
+		activeFrom = &activeTime
+	}
+
+	opts := models.GenerateOptions{
+		Expire:       expire,
+		ActiveFrom:   activeFrom,
+		PrelaunchUrl: req.PrelaunchUrl,
+		Alias:        req.Alias,
+		Owner:        owner,
+		Password:     req.Password,
+		MaxClicks:    req.MaxClicks,
+
+		RedirectType:     req.RedirectType,
+		QueryPassthrough: req.QueryPassthrough,
+		Utm:              req.Utm.params(),
+		Rules:            redirectRules(req.Rules),
+		Variants:         splitVariants(req.Variants),
+		SplitMode:        req.SplitMode,
+		DeepLink:         req.DeepLink.deepLink(),
+		Title:            req.Title,
+		Interstitial:     req.Interstitial,
+	}
+
+	if err := checkBlacklist(log, opts.Targets(req.Url)...); err != nil {
+		return nil, false, http.StatusBadRequest, err
+	}
+
+	if req.Dedupe {
+		item, err := u.model.FindReusable(req.Url, opts)
+		if err == nil {
+			log.With(zap.String("shorten_code", item.Key)).Info("Shorten url reused")
+			return item, true, http.StatusOK, nil
+		}
+		if !errors.Is(err, models.ErrNotFound) {
+			return nil, false, http.StatusBadGateway, err
+		}
+	}
+
 	// Generate new shorten url
-	item, err := u.model.Generate(req.Url, expire)
+	item, err := u.model.GenerateWithOptions(req.Url, opts)
 	if err != nil {
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Response{
-			Success: false,
-			Message: err.Error(),
-		})
-		return
+		if errors.Is(err, models.ErrAliasTaken) || errors.Is(err, models.ErrAliasReserved) {
+			return nil, false, http.StatusConflict, err
+		}
+
+		return nil, false, http.StatusBadRequest, err
 	}
 
 	log.With(zap.String("shorten_code", item.Key)).Info("New shorten url generated")
-	render.JSON(w, r, Response{
-		Success: true,
-		ShortenUrl: strings.Join([]string{
-			viper.GetString("server.addr"),
-			":",
-			viper.GetString("server.port"),
-			"/r/",
-			item.Key,
-		}, ""),
-		ShortenCode: item.Key,
-	})
+	return item, false, http.StatusOK, nil
+}
+
+// checkBlacklist refuses the urls matching a blacklist pattern
+func checkBlacklist(log *zap.Logger, urls ...string) error {
+	blackLists := viper.GetStringSlice(keyBlacklist)
+	for _, url := range urls {
+		for _, blacklist := range blackLists {
+			matched, err := regexp.Match(regexp.QuoteMeta(blacklist), []byte(url))
+			if err != nil {
+				log.With(zap.String("blacklist_pattern", blacklist)).Error("failed to matching")
+			}
+
+			if matched {
+				return ErrBlacklisted
+			}
+		}
+	}
+
+	return nil
+}
+
+// shortenUrl builds the public short url of a shorten code
+func shortenUrl(code string) string {
+	return strings.Join([]string{
+		viper.GetString("server.addr"),
+		":",
+		viper.GetString("server.port"),
+		"/r/",
+		code,
+	}, "")
 }
 
 func (u *Url) Redirect(w http.ResponseWriter, r *http.Request) {
 	log := libs.GetLogEntry(r)
 	shortenCode := core.RouteContext(r.Context()).RouteParams.Get("code")
 	if len(shortenCode) == 0 {
-		render.Status(r, http.StatusNotFound)
+		NotFound(w, r)
+		return
+	}
+
+	if code, ok := previewCode(shortenCode); ok {
+		u.preview(w, r, code)
 		return
 	}
 
 	log = log.With(zap.String("code", shortenCode))
 
-	// Find shorten item
-	item, err := u.model.FindByShortCode(shortenCode, true)
+	// Bots are redirected, but not counted as hits
+	verdict, err := u.bots.Classify(r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("fail to classify request")
+	}
+
+	// Find shorten item, the hit is counted once the visitor gets through
+	item, err := u.model.FindByShortCode(shortenCode, false)
+	if errors.Is(err, models.ErrFlagged) {
+		if !confirmed(r) {
+			warning(w, r, item)
+			return
+		}
+		err = nil
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			render.Status(r, http.StatusNotFound)
-			render.NoContent(w, r)
+			NotFound(w, r)
+			return
+		}
+
+		if unavailable(w, r, err) {
 			return
 		}
 
 		if errors.Is(err, models.ErrExpired) {
-			render.Status(r, http.StatusGone)
-			render.NoContent(w, r)
+			Gone(w, r)
+			return
+		}
+
+		if errors.Is(err, models.ErrNotActive) {
+			notActive(w, r, item)
 			return
 		}
 
@@ -130,42 +310,165 @@ func (u *Url) Redirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Redirect to origin url
-	http.Redirect(w, r, item.Origin, http.StatusFound)
-}
+	// Links previewed before every redirect wait for the visitor to continue
+	if !confirmed(r) && interstitial(item) {
+		previewPage(w, r, item)
+		return
+	}
 
-func (u *Url) parseRequestAndValidate(r *http.Request) (log *zap.Logger, req *Request, err error) {
-	log = libs.GetLogEntry(r)
-	req = &Request{}
-	if err = libs.DecodeJSON(r.Body, req); err != nil {
-		log.Info("create account error", zap.Error(err))
+	if !u.unlock(w, r, log, item) {
 		return
 	}
 
-	log = log.With(zap.String("url", req.Url), zap.String("expire", req.Expire))
-	_, err = govalidator.ValidateStruct(req)
+	// Unfurlers would use the clicks of limited links, they are followed
+	// without counting
+	if item.MaxClicks != nil && !verdict.Bot {
+		if err := u.model.Consume(item); err != nil {
+			if errors.Is(err, models.ErrExpired) {
+				Gone(w, r)
+				return
+			}
+
+			log.With(zap.Error(err)).Error("fail to consume click")
+			render.Status(r, http.StatusBadRequest)
+			render.NoContent(w, r)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	query.Del(continueParam)
+	if query.Get(sourceParam) == sourceQr {
+		query.Del(sourceParam)
+	}
+	event := newClickEvent(r, shortenCode, u.geo)
+	routing, err := item.Route(newVisitor(r, event), query)
 	if err != nil {
-		log.Error("request invalid", zap.Error(err))
+		log.With(zap.Error(err)).Error("fail to route visitor")
+		render.Status(r, http.StatusBadRequest)
+		render.NoContent(w, r)
 		return
 	}
-	return
-}
+	event.Rule, event.Variant = routing.Rule, routing.Variant
+	keepVariant(w, r, shortenCode, item, routing.Variant)
 
-func NewUrlController(log *zap.Logger, client *redis.Client, db *gorm.DB) (*Url, error) {
-	govalidator.TagMap["time"] = func(str string) bool {
-		if len(str) == 0 {
-			return true
+	// Analytics never delay the redirect
+	event.Bot, event.BotReason = verdict.Bot, verdict.Reason
+	u.clicks.Write(event)
+	if !verdict.Bot {
+		if err := u.model.Hit(shortenCode); err != nil {
+			log.With(zap.Error(err)).Error("fail to count hit")
+		}
+		if err := u.model.CountVisitor(shortenCode, clientIP(r).String(), r.UserAgent()); err != nil {
+			log.With(zap.Error(err)).Error("fail to count visitor")
 		}
+	}
 
-		return govalidator.IsTime(str, libs.TimeFormat)
+	// Mobiles open the app of the link unless a rule routed them, bots follow the redirect
+	if len(routing.Rule) == 0 && !verdict.Bot && handoff(w, r, item, routing.Destination) {
+		return
+	}
+
+	switch item.RedirectType {
+	case models.RedirectMeta, models.RedirectJS:
+		render.HTML(w, r, "refresh", RefreshPage{
+			Url:    routing.Destination,
+			Script: item.RedirectType == models.RedirectJS,
+		})
+	default:
+		status := redirectStatus(r, item)
+		if status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect {
+			// Permanent redirects are cached forever by browsers without it
+			maxAge := int(viper.GetDuration(keyPermanentMaxAge).Seconds())
+			w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+		}
+		http.Redirect(w, r, routing.Destination, status)
+	}
+}
+
+// redirectStatus returns the status of the redirect of a link. The password
+// form is answered with a GET whatever the type of the link, so the password
+// is not posted again to the destination.
+func redirectStatus(r *http.Request, item *models.Url) int {
+	if passwordForm(r) {
+		return http.StatusSeeOther
+	}
+
+	switch item.RedirectType {
+	case models.RedirectPermanent:
+		return http.StatusMovedPermanently
+	case models.RedirectTemporary:
+		return http.StatusTemporaryRedirect
+	case models.RedirectPermanentRedirect:
+		return http.StatusPermanentRedirect
+	}
+
+	return http.StatusFound
+}
+
+func (req *UtmRequest) params() models.UtmParams {
+	if req == nil {
+		return models.UtmParams{}
+	}
+
+	return models.UtmParams{
+		Source:   req.Source,
+		Medium:   req.Medium,
+		Campaign: req.Campaign,
+		Term:     req.Term,
+		Content:  req.Content,
+	}
+}
+
+// notActive answers the redirects of a scheduled link, sending visitors to
+// the pre-launch url when there is one
+func notActive(w http.ResponseWriter, r *http.Request, item *models.Url) {
+	prelaunch := item.PrelaunchUrl
+	if len(prelaunch) == 0 {
+		prelaunch = viper.GetString(keyScheduledUrl)
+	}
+	if len(prelaunch) != 0 {
+		http.Redirect(w, r, prelaunch, http.StatusFound)
+		return
 	}
 
+	render.Status(r, viper.GetInt(keyScheduledStatus))
+	if wantsHTML(r) {
+		render.HTML(w, r, "scheduled", item)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+func NewUrlController(log *zap.Logger, client *redis.Client, db *gorm.DB) (*Url, error) {
 	model, err := models.NewUrlModel(log, client, db)
 	if err != nil {
 		return nil, errors.Wrap(err, "NewUrlController")
 	}
 
+	clicks, err := models.NewClickWriter(log, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "models.NewClickWriter")
+	}
+	go clicks.Run(context.Background())
+
+	geo, err := libs.NewGeoIPFromViper(log)
+	if err != nil {
+		return nil, errors.Wrap(err, "libs.NewGeoIPFromViper")
+	}
+
+	logo, err := newQrLogo(log)
+	if err != nil {
+		return nil, errors.Wrap(err, "newQrLogo")
+	}
+
 	return &Url{
-		model: model,
+		model:  model,
+		clicks: clicks,
+		geo:    geo,
+		bots:   NewBotDetector(client),
+		redis:  client,
+		logo:   logo,
 	}, nil
 }
@@ -1,15 +1,19 @@
 package controllers
 
 import (
+	"bytes"
 	"encoding/json"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -20,6 +24,7 @@ import (
 
 	"github.com/danielnguyentb/url-shortener/core"
 	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/server/models"
 )
 
 func TestUrlCtrl(t *testing.T) {
@@ -51,7 +56,9 @@ func TestUrlCtrl(t *testing.T) {
 
 	r := core.NewRouter()
 	r.Post("/create", urlCtrl.CreateShorten)
+	r.Get("/r/:code/qr", urlCtrl.QrCode)
 	r.Get("/r/:code", urlCtrl.Redirect)
+	r.Patch("/links/:code", urlCtrl.UpdateLink)
 
 	log.Debug("Request create shorten with empty body, request should fail")
 	req, err := json.Marshal(Request{})
@@ -72,6 +79,8 @@ func TestUrlCtrl(t *testing.T) {
 	require.NotNil(t, body)
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assert.Equal(t, false, body.Success)
+	require.Len(t, body.Errors, 1)
+	assert.Equal(t, "url", body.Errors[0].Field)
 
 	log.Debug("Request create shorten with invalid expire, request should fail")
 	req, err = json.Marshal(Request{
@@ -88,7 +97,7 @@ func TestUrlCtrl(t *testing.T) {
 	log.Debug("Request create shorten with valid shorten")
 	req, err = json.Marshal(Request{
 		Url:    "http://yahoo.com",
-		Expire: "2022-01-01 00:00:00",
+		Expire: time.Now().Add(24 * time.Hour).Format(libs.TimeFormat),
 	})
 	require.NoError(t, err)
 	resp, body, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
@@ -99,6 +108,18 @@ func TestUrlCtrl(t *testing.T) {
 	assert.NotEmpty(t, body.ShortenUrl)
 	assert.NotEmpty(t, body.ShortenCode)
 
+	log.Debug("Request create shorten with form body")
+	form := url.Values{"url": {"http://bing.com"}}
+	formReq, _ := http.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+	formReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, formReq)
+	assert.Equal(t, http.StatusOK, w.Code)
+	formBody := &Response{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), formBody))
+	assert.True(t, formBody.Success)
+	assert.NotEmpty(t, formBody.ShortenCode)
+
 	log.Debug("Request to redirect url")
 	resp, _, err = testHandler(t, log, r, "GET",
 		strings.Join([]string{"/r/", body.ShortenCode}, ""), strings.NewReader(""))
@@ -109,6 +130,336 @@ func TestUrlCtrl(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, location.String())
 
+	log.Debug("Request to redirect url from a browser")
+	browserReq, _ := http.NewRequest("GET", "/r/"+body.ShortenCode, nil)
+	browserReq.Header.Set("User-Agent", browserUserAgent)
+	browserReq.Header.Set("Accept-Language", "en-US")
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, browserReq)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	log.Debug("Both redirects should be stored as click events, only the browser is counted")
+	assert.Eventually(t, func() bool {
+		var count int64
+		require.NoError(t, db.Model(&models.ClickEvent{}).Where("code = ?", body.ShortenCode).Count(&count).Error)
+		return count == 2
+	}, 5*time.Second, 100*time.Millisecond)
+	var bots int64
+	require.NoError(t, db.Model(&models.ClickEvent{}).Where("code = ? AND bot = ?", body.ShortenCode, true).Count(&bots).Error)
+	assert.Equal(t, int64(1), bots)
+	item, err := urlCtrl.model.FindByShortCode(body.ShortenCode, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), item.Hits)
+
+	log.Debug("Request create shorten with alias")
+	req, err = json.Marshal(Request{
+		Url:   "http://yahoo.com",
+		Alias: "my-alias",
+	})
+	require.NoError(t, err)
+	resp, body, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "my-alias", body.ShortenCode)
+
+	log.Debug("Request create shorten with taken alias, conflict expected")
+	req, err = json.Marshal(Request{
+		Url:   "http://yahoo.com",
+		Alias: "My-Alias",
+	})
+	require.NoError(t, err)
+	resp, body, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.False(t, body.Success)
+
+	log.Debug("Request create shorten with reserved alias, conflict expected")
+	req, err = json.Marshal(Request{
+		Url:   "http://yahoo.com",
+		Alias: "admin",
+	})
+	require.NoError(t, err)
+	resp, _, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	log.Debug("Request create shorten with invalid alias, request should fail")
+	req, err = json.Marshal(Request{
+		Url:   "http://yahoo.com",
+		Alias: "my alias!",
+	})
+	require.NoError(t, err)
+	resp, body, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Len(t, body.Errors, 1)
+	assert.Equal(t, "alias", body.Errors[0].Field)
+
+	log.Debug("Request create shorten twice with dedupe, same code expected")
+	viper.Set(keyApiKeys, []map[string]string{{"key": "secret-key", "owner": "marketing"}})
+	createWithKey := func(req Request, apiKey string) (*http.Response, *Response) {
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		httpReq, _ := http.NewRequest("POST", "/create", strings.NewReader(string(b)))
+		httpReq.Header.Set(keyApiKeyHeader, apiKey)
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		res := &Response{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), res))
+		return w.Result(), res
+	}
+	resp, first := createWithKey(Request{Url: "http://dedupe.com", Dedupe: true}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, first.Reused)
+	resp, second := createWithKey(Request{Url: "http://dedupe.com/", Dedupe: true}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, second.Reused)
+	assert.Equal(t, first.ShortenCode, second.ShortenCode)
+
+	log.Debug("Anonymous owner does not reuse the links of an api key")
+	req, err = json.Marshal(Request{Url: "http://dedupe.com", Dedupe: true})
+	require.NoError(t, err)
+	resp, body, err = testHandler(t, log, r, "POST", "/create", strings.NewReader(string(req)))
+	require.NoError(t, err)
+	assert.False(t, body.Reused)
+	assert.NotEqual(t, first.ShortenCode, body.ShortenCode)
+
+	log.Debug("Request create shorten with unknown api key, unauthorized expected")
+	resp, _ = createWithKey(Request{Url: "http://dedupe.com"}, "wrong-key")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	log.Debug("Request to protected shorten needs the password header")
+	resp, protected := createWithKey(Request{Url: "http://docs.internal.com", Password: "s3cret"}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	redirectWithPassword := func(password string) *http.Response {
+		httpReq, _ := http.NewRequest("GET", "/r/"+protected.ShortenCode, nil)
+		if len(password) != 0 {
+			httpReq.Header.Set(keyLinkPasswordHeader, password)
+		}
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		return w.Result()
+	}
+	assert.Equal(t, http.StatusUnauthorized, redirectWithPassword("").StatusCode)
+	assert.Equal(t, http.StatusForbidden, redirectWithPassword("wrong").StatusCode)
+	resp = redirectWithPassword("s3cret")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://docs.internal.com", resp.Header.Get("Location"))
+
+	log.Debug("Request to one-time shorten redirects once, bots don't use the click")
+	resp, once := createWithKey(Request{Url: "http://once.com", MaxClicks: 1}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	redirectFrom := func(userAgent string) int {
+		httpReq, _ := http.NewRequest("GET", "/r/"+once.ShortenCode, nil)
+		httpReq.Header.Set("User-Agent", userAgent)
+		httpReq.Header.Set("Accept-Language", "en-US")
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusFound, redirectFrom("Slackbot-LinkExpanding 1.0"))
+	assert.Equal(t, http.StatusFound, redirectFrom(browserUserAgent))
+	assert.Equal(t, http.StatusGone, redirectFrom(browserUserAgent))
+
+	log.Debug("Request to scheduled shorten goes to its pre-launch url")
+	activeFrom := time.Now().Add(time.Hour).UTC().Format(libs.TimeFormat)
+	resp, scheduled := createWithKey(Request{Url: "http://launch.com", ActiveFrom: activeFrom, PrelaunchUrl: "http://launch.com/soon"}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, err = testHandler(t, log, r, "GET", "/r/"+scheduled.ShortenCode, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://launch.com/soon", resp.Header.Get("Location"))
+
+	log.Debug("Request to scheduled shorten without pre-launch url gets the configured status")
+	resp, scheduled = createWithKey(Request{Url: "http://launch.com", ActiveFrom: activeFrom}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, err = testHandler(t, log, r, "GET", "/r/"+scheduled.ShortenCode, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	log.Debug("Request to permanent shorten passes the query through with the utm params")
+	resp, tagged := createWithKey(Request{
+		Url:              "http://tagged.com/?ref=link",
+		RedirectType:     "301",
+		QueryPassthrough: "preserve",
+		Utm:              &UtmRequest{Source: "newsletter", Medium: "email"},
+	}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, err = testHandler(t, log, r, "GET", "/r/"+tagged.ShortenCode+"?ref=visitor&lang=en", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "private, max-age=300", resp.Header.Get("Cache-Control"))
+	location, err = resp.Location()
+	require.NoError(t, err)
+	assert.Equal(t, "link", location.Query().Get("ref"))
+	assert.Equal(t, "en", location.Query().Get("lang"))
+	assert.Equal(t, "newsletter", location.Query().Get("utm_source"))
+	assert.Equal(t, "email", location.Query().Get("utm_medium"))
+
+	log.Debug("Request create shorten with unknown redirect type, request should fail")
+	resp, _ = createWithKey(Request{Url: "http://tagged.com", RedirectType: "303"}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	log.Debug("Request to routed shorten sends visitors by their rules, the rule is recorded with the click")
+	resp, routed := createWithKey(Request{
+		Url: "http://routed.com",
+		Rules: []RuleRequest{
+			{Name: "ios", OS: []string{"iOS"}, Target: "https://apps.apple.com/app/id1"},
+			{Name: "german", Languages: []string{"de"}, Target: "http://routed.com/de"},
+		},
+	}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	redirectAs := func(userAgent, language string) string {
+		httpReq, _ := http.NewRequest("GET", "/r/"+routed.ShortenCode, nil)
+		httpReq.Header.Set("User-Agent", userAgent)
+		httpReq.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		return w.Header().Get("Location")
+	}
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1"
+	assert.Equal(t, "https://apps.apple.com/app/id1", redirectAs(iphone, "en-US"))
+	assert.Equal(t, "http://routed.com/de", redirectAs(browserUserAgent, "de-DE,de;q=0.9"))
+	assert.Equal(t, "http://routed.com", redirectAs(browserUserAgent, "en-US"))
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&models.ClickEvent{}).Where("code = ? AND rule = ?", routed.ShortenCode, "ios").Count(&count)
+		return count == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	log.Debug("Request create shorten with a rule without target, request should fail")
+	resp, invalid := createWithKey(Request{Url: "http://routed.com", Rules: []RuleRequest{{OS: []string{"iOS"}}}}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotEmpty(t, invalid.Errors)
+
+	log.Debug("Request create shorten with a blacklisted rule target, request should fail")
+	resp, _ = createWithKey(Request{Url: "http://routed.com", Rules: []RuleRequest{{Target: "http://google.com"}}}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	log.Debug("Request to split shorten assigns a variant kept by a cookie")
+	resp, split := createWithKey(Request{
+		Url: "http://split.com",
+		Variants: []VariantRequest{
+			{Name: "a", Target: "http://split.com/a", Weight: 70},
+			{Name: "b", Target: "http://split.com/b", Weight: 30},
+		},
+	}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, err = testHandler(t, log, r, "GET", "/r/"+split.ShortenCode, nil)
+	require.NoError(t, err)
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "variant-"+split.ShortenCode, cookies[0].Name)
+	assert.Equal(t, "http://split.com/"+cookies[0].Value, resp.Header.Get("Location"))
+	for i := 0; i < 5; i++ {
+		httpReq, _ := http.NewRequest("GET", "/r/"+split.ShortenCode, nil)
+		httpReq.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		assert.Equal(t, "http://split.com/"+cookies[0].Value, w.Header().Get("Location"))
+		assert.Empty(t, w.Result().Cookies())
+	}
+
+	log.Debug("Request create shorten with a variant name not kept by cookies, request should fail")
+	resp, invalid = createWithKey(Request{Url: "http://split.com", Variants: []VariantRequest{
+		{Name: `spring "sale"; v2`, Target: "http://split.com/a", Weight: 1},
+	}}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotEmpty(t, invalid.Errors)
+
+	log.Debug("Request create shorten with variants without weight, request should fail")
+	resp, _ = createWithKey(Request{Url: "http://split.com", Variants: []VariantRequest{{Target: "http://split.com/a"}}}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	log.Debug("Request create shorten with a script as app url, request should fail")
+	resp, invalid = createWithKey(Request{Url: "http://app.com", DeepLink: &DeepLinkRequest{Ios: "javascript:alert(1)"}}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotEmpty(t, invalid.Errors)
+
+	log.Debug("Request QR code of a shorten, the png size is rounded up and cached")
+	resp, scan := createWithKey(Request{Url: "http://scan.com/menu", QueryPassthrough: "preserve"}, "secret-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	qrPath := "/r/" + scan.ShortenCode + "/qr"
+	resp, _, err = testHandler(t, log, r, "GET", qrPath+"?size=300&margin=2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	qr, err := png.Decode(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 512, qr.Bounds().Dx())
+	cached, err := mr.HKeys("qr-" + scan.ShortenCode)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"png-512-M-2-false"}, cached)
+
+	log.Debug("Renders beyond the cached entries of a link are not cached")
+	viper.Set(keyQrCacheEntries, 2)
+	for _, margin := range []string{"0", "1", "2"} {
+		resp, _, err = testHandler(t, log, r, "GET", qrPath+"?size=128&margin="+margin, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	cached, err = mr.HKeys("qr-" + scan.ShortenCode)
+	require.NoError(t, err)
+	assert.Len(t, cached, 2)
+	viper.Set(keyQrCacheEntries, nil)
+
+	log.Debug("Request QR code as svg")
+	resp, _, err = testHandler(t, log, r, "GET", qrPath+"?format=svg&ecc=H", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	svg, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(svg, []byte("<svg ")))
+
+	log.Debug("Request QR code with invalid parameters, request should fail")
+	for _, query := range []string{"?format=gif", "?size=10", "?size=2048", "?margin=16", "?ecc=X", "?logo=true"} {
+		resp, _, err = testHandler(t, log, r, "GET", qrPath+query, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+	resp, _, err = testHandler(t, log, r, "GET", "/r/non-exists/qr", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	log.Debug("Request to shorten scanned from a QR code drops the marker and records the source")
+	resp, _, err = testHandler(t, log, r, "GET", "/r/"+scan.ShortenCode+"?src=qr&table=4", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://scan.com/menu?table=4", resp.Header.Get("Location"))
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&models.ClickEvent{}).Where("code = ? AND source = ?", scan.ShortenCode, "qr").Count(&count)
+		return count == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	log.Debug("Owners patch their own links with their api key only")
+	patchWithKey := func(code, apiKey string) int {
+		httpReq, _ := http.NewRequest("PATCH", "/links/"+code, strings.NewReader(`{"url": "http://once.com/fixed"}`))
+		httpReq.Header.Set("Content-Type", "application/json")
+		if len(apiKey) != 0 {
+			httpReq.Header.Set(keyApiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, patchWithKey(once.ShortenCode, ""))
+	assert.Equal(t, http.StatusOK, patchWithKey(once.ShortenCode, "secret-key"))
+	assert.Equal(t, http.StatusNotFound, patchWithKey(body.ShortenCode, "secret-key"))
+
+	log.Debug("Patch with a blacklisted variant target, request should fail")
+	httpReq, _ := http.NewRequest("PATCH", "/links/"+once.ShortenCode, strings.NewReader(`{"variants": [{"target": "http://google.com/a", "weight": 1}]}`))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(keyApiKeyHeader, "secret-key")
+	w = httptest.NewRecorder()
+	libs.NewZapLogEntry(log)(r).ServeHTTP(w, httpReq)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrBlacklisted.Error())
+
+	log.Debug("Request create shorten with too short password, request should fail")
+	resp, _ = createWithKey(Request{Url: "http://docs.internal.com", Password: "abc"}, "secret-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
 	log.Debug("Request to non-exists shorten")
 	resp, _, err = testHandler(t, log, r, "GET", "/r/non-exists", strings.NewReader(""))
 	require.NoError(t, err)
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+const (
+	// keyVariantsCookieTTL is how long visitors keep the variant of a split
+	keyVariantsCookieTTL = "variants.cookieTTL"
+
+	variantCookiePrefix = "variant-"
+)
+
+// VariantRequest is a destination of a split link, visitors are sent to the
+// variants in proportion of their weights
+type VariantRequest struct {
+	// Name is made of letters, digits, dots, dashes and underscores
+	Name   string `valid:"optional,variantname" json:"name,omitempty"`
+	Target string `valid:"required,url" json:"target"`
+	Weight uint   `valid:"optional" json:"weight"`
+}
+
+func init() {
+	viper.SetDefault(keyVariantsCookieTTL, 30*24*time.Hour)
+	render.RegisterValidator("variantname", models.ValidVariantName)
+}
+
+// splitVariants converts the requested variants
+func splitVariants(reqs []VariantRequest) models.Variants {
+	var variants models.Variants
+	for _, req := range reqs {
+		variants = append(variants, models.Variant{
+			Name:   req.Name,
+			Target: req.Target,
+			Weight: req.Weight,
+		})
+	}
+
+	return variants
+}
+
+// variantCookie is the cookie keeping the variant of a visitor for a code
+func variantCookie(code string) string {
+	return variantCookiePrefix + code
+}
+
+// assignedVariant returns the variant kept by a visitor for a code
+func assignedVariant(r *http.Request, code string) string {
+	cookie, err := r.Cookie(variantCookie(code))
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// keepVariant lets the visitor keep the variant of a random split, under the
+// code the visitor requested
+func keepVariant(w http.ResponseWriter, r *http.Request, code string, item *models.Url, variant string) {
+	if len(variant) == 0 || item.SplitMode == models.SplitHash || variant == assignedVariant(r, code) {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookie(code),
+		Value:    variant,
+		Path:     strings.Join([]string{"/r/", code}, ""),
+		MaxAge:   int(viper.GetDuration(keyVariantsCookieTTL).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
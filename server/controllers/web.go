@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/middlewares"
+	"github.com/danielnguyentb/url-shortener/server/models"
+)
+
+// HomePage is the data of the shorten form page
+type HomePage struct {
+	CSRFToken string
+	Request   Request
+	Message   string
+	Errors    map[string]string
+}
+
+// ResultPage is the data of the page showing a new short link
+type ResultPage struct {
+	ShortenUrl string
+	Item       *models.Url
+	Reused     bool
+}
+
+// Home renders the shorten form for browsers, other clients get the service status
+func (u *Url) Home(w http.ResponseWriter, r *http.Request) {
+	if !wantsHTML(r) {
+		render.JSON(w, r, map[string]string{
+			"status": "ok",
+		})
+		return
+	}
+
+	render.HTML(w, r, "home", HomePage{
+		CSRFToken: middlewares.CSRFToken(r),
+	})
+}
+
+// Shorten handles the shorten form posted from the home page
+func (u *Url) Shorten(w http.ResponseWriter, r *http.Request) {
+	log := libs.GetLogEntry(r)
+	req := &Request{}
+	if err := render.Bind(r, req); err != nil {
+		log.Info("form invalid", zap.Error(err))
+		page := HomePage{
+			CSRFToken: middlewares.CSRFToken(r),
+			Request:   *req,
+			Errors:    map[string]string{},
+		}
+		for _, field := range render.FieldErrors(err) {
+			page.Errors[field.Field] = field.Message
+		}
+		if len(page.Errors) == 0 {
+			page.Message = err.Error()
+		}
+
+		render.Status(r, http.StatusBadRequest)
+		render.HTML(w, r, "home", page)
+		return
+	}
+
+	item, reused, status, err := u.shorten(log, req, "")
+	if err != nil {
+		render.Status(r, status)
+		render.HTML(w, r, "home", HomePage{
+			CSRFToken: middlewares.CSRFToken(r),
+			Request:   *req,
+			Message:   err.Error(),
+		})
+		return
+	}
+
+	render.HTML(w, r, "result", ResultPage{
+		ShortenUrl: shortenUrl(item.Key),
+		Item:       item,
+		Reused:     reused,
+	})
+}
+
+// NotFound responds with a 404, rendering a page for browsers
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusNotFound)
+	if wantsHTML(r) {
+		render.HTML(w, r, "404", nil)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// Gone responds with a 410, rendering a page for browsers
+func Gone(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusGone)
+	if wantsHTML(r) {
+		render.HTML(w, r, "410", nil)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// wantsHTML reports whether the client asked for an HTML document
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
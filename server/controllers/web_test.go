@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/danielnguyentb/url-shortener/core"
+	"github.com/danielnguyentb/url-shortener/libs"
+	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/middlewares"
+	"github.com/danielnguyentb/url-shortener/server/models"
+	"github.com/danielnguyentb/url-shortener/web"
+)
+
+func TestWebCtrl(t *testing.T) {
+	log := libs.InitLogging()
+
+	log.Debug("Initialize db, redis connection and templates")
+	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
+	defer func() {
+		require.NoError(t, os.Remove("test.db"))
+	}()
+	require.NoError(t, err)
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	require.NoError(t, render.LoadTemplates(web.FS, web.LayoutsPattern, web.PagesPattern))
+
+	urlCtrl, err := NewUrlController(log, client, db)
+	require.NoError(t, err)
+
+	r := core.NewRouter()
+	r.Method(http.MethodGet, "/", middlewares.CSRF(http.HandlerFunc(urlCtrl.Home)))
+	r.Method(http.MethodPost, "/shorten", middlewares.CSRF(http.HandlerFunc(urlCtrl.Shorten)))
+	r.Get("/r/:code", urlCtrl.Redirect)
+	r.Get("/p/:code", urlCtrl.Preview)
+	r.Method(http.MethodPost, "/r/:code", middlewares.CSRFUnless(RedirectCSRFExempt)(http.HandlerFunc(urlCtrl.Redirect)))
+	h := libs.NewZapLogEntry(log)(r)
+
+	log.Debug("Home without html accept returns status")
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+
+	log.Debug("Home for browsers renders the form with a csrf cookie")
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, w.Body.String(), `action="/shorten"`)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	csrf := cookies[0]
+	assert.Contains(t, w.Body.String(), csrf.Value)
+
+	postForm := func(form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/shorten", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	log.Debug("Post form without csrf token is forbidden")
+	w = postForm(url.Values{"url": {"http://example.com"}}, csrf)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	log.Debug("Post form with invalid url renders the form again")
+	w = postForm(url.Values{"url": {"abc"}, middlewares.CSRFFieldName: {csrf.Value}}, csrf)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "does not validate as url")
+
+	log.Debug("Post valid form renders the result page")
+	w = postForm(url.Values{"url": {"http://example.com"}, middlewares.CSRFFieldName: {csrf.Value}}, csrf)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "/r/")
+	assert.Contains(t, w.Body.String(), "http://example.com")
+
+	log.Debug("Protected link prompts browsers for the password")
+	item, err := urlCtrl.model.GenerateWithOptions("http://docs.internal.com", models.GenerateOptions{Password: "s3cret"})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(csrf)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `action="/r/`+item.Key+`"`)
+	assert.Contains(t, w.Body.String(), csrf.Value)
+
+	postPassword := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}, middlewares.CSRFFieldName: {csrf.Value}}
+		req, _ := http.NewRequest("POST", "/r/"+item.Key, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html")
+		req.AddCookie(csrf)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	log.Debug("Wrong password renders the prompt again")
+	w = postPassword("wrong")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), models.ErrPasswordInvalid.Error())
+
+	log.Debug("Right password redirects to the origin")
+	w = postPassword("s3cret")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "http://docs.internal.com", w.Header().Get("Location"))
+
+	log.Debug("JSON posts need the csrf token unless an api key is sent")
+	postJSON := func(apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/r/"+item.Key, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(keyLinkPasswordHeader, "s3cret")
+		if len(apiKey) != 0 {
+			req.Header.Set(keyApiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	viper.Set(keyApiKeys, []map[string]string{{"key": "secret-key", "owner": "marketing"}})
+	defer viper.Set(keyApiKeys, nil)
+	assert.Equal(t, http.StatusForbidden, postJSON("").Code)
+	assert.Equal(t, http.StatusForbidden, postJSON("forged-key").Code)
+	w = postJSON("secret-key")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://docs.internal.com", w.Header().Get("Location"))
+
+	log.Debug("Posts without a password are redirected with the type of the link")
+	item, err = urlCtrl.model.GenerateWithOptions("http://hooks.com/in", models.GenerateOptions{RedirectType: models.RedirectTemporary})
+	require.NoError(t, err)
+	for _, contentType := range []string{"application/json", "application/x-www-form-urlencoded"} {
+		req, _ := http.NewRequest("POST", "/r/"+item.Key, strings.NewReader(`event=signup`))
+		req.Header.Set("Content-Type", contentType)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code, contentType)
+		assert.Equal(t, "http://hooks.com/in", w.Header().Get("Location"))
+	}
+
+	log.Debug("Scheduled link renders the not active page for browsers")
+	activeFrom := time.Date(2099, 1, 1, 9, 0, 0, 0, time.UTC)
+	item, err = urlCtrl.model.GenerateWithOptions("http://launch.com", models.GenerateOptions{ActiveFrom: &activeFrom})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "2099-01-01 09:00")
+
+	log.Debug("Flagged link renders a warning before redirecting")
+	item, err = urlCtrl.model.Generate("http://suspicious.com", nil)
+	require.NoError(t, err)
+	flagged := models.StateFlagged
+	_, err = urlCtrl.model.Update(item.Key, "", 0, models.UrlChanges{State: &flagged, Reason: "reported as phishing"})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "reported as phishing")
+	assert.Contains(t, w.Body.String(), "/r/"+item.Key+"?continue=1")
+	req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	warned := PreviewPage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &warned))
+	assert.Contains(t, warned.Warning, "reported as phishing")
+	req, _ = http.NewRequest("GET", "/r/"+item.Key+"?continue=1", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://suspicious.com", w.Header().Get("Location"))
+
+	log.Debug("Link taken down for legal reasons responds with 451")
+	takedown := models.StateTakenDown
+	_, err = urlCtrl.model.Update(item.Key, "", 0, models.UrlChanges{State: &takedown})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, w.Code)
+	assert.Contains(t, w.Body.String(), "legal")
+
+	log.Debug("Meta refresh link renders a page redirecting to the destination")
+	refresh, err := urlCtrl.model.GenerateWithOptions("http://refresh.com/?a=1", models.GenerateOptions{RedirectType: models.RedirectMeta})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/r/"+refresh.Key+"?b=2", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `http-equiv="refresh"`)
+	assert.Contains(t, w.Body.String(), "http://refresh.com/?a=1")
+
+	log.Debug("App link hands mobiles off to the app with the store as fallback")
+	app, err := urlCtrl.model.GenerateWithOptions("http://app.com/item/1", models.GenerateOptions{DeepLink: models.DeepLink{
+		Ios:          "exampleapp://item/1",
+		IosStore:     "https://apps.apple.com/app/id1",
+		Android:      "intent://item/1#Intent;scheme=exampleapp;package=com.example.app;end",
+		AndroidStore: "https://play.google.com/store/apps/details?id=com.example.app",
+	}})
+	require.NoError(t, err)
+	openApp := func(userAgent string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/r/"+app.Key, nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Accept-Language", "en-US")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	w = openApp("Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href="exampleapp://item/1"`)
+	assert.Contains(t, w.Body.String(), `"https://apps.apple.com/app/id1"`)
+	w = openApp("Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "intent://item/1")
+	assert.Contains(t, w.Body.String(), "play.google.com")
+	w = openApp(browserUserAgent)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://app.com/item/1", w.Header().Get("Location"))
+
+	log.Debug("Preview shows the destination of a link without counting a hit")
+	previewed, err := urlCtrl.model.GenerateWithOptions("http://preview.com/page", models.GenerateOptions{Title: "Spring sale"})
+	require.NoError(t, err)
+	for _, path := range []string{"/r/" + previewed.Key + "+", "/p/" + previewed.Key} {
+		req, _ = http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "text/html")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "http://preview.com/page")
+		assert.Contains(t, w.Body.String(), "Spring sale")
+		assert.Contains(t, w.Body.String(), "/r/"+previewed.Key+"?continue=1")
+	}
+	lookup, err := urlCtrl.model.FindByShortCode(previewed.Key, false)
+	require.NoError(t, err)
+	assert.Zero(t, lookup.Hits)
+
+	log.Debug("Preview of protected link hides its destination, other clients get json")
+	hidden, err := urlCtrl.model.GenerateWithOptions("http://preview.com/secret", models.GenerateOptions{Password: "s3cret"})
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "/p/"+hidden.Key, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	page := PreviewPage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.True(t, page.Protected)
+	assert.Empty(t, page.Origin)
+	assert.Equal(t, string(models.StateActive), page.State)
+
+	log.Debug("Preview of scheduled and deleted links hides their destination")
+	scheduled, err := urlCtrl.model.GenerateWithOptions("http://preview.com/launch", models.GenerateOptions{
+		Title:        "Launch",
+		ActiveFrom:   &activeFrom,
+		PrelaunchUrl: "http://preview.com/soon",
+	})
+	require.NoError(t, err)
+	deleted, err := urlCtrl.model.GenerateWithOptions("http://preview.com/removed", models.GenerateOptions{})
+	require.NoError(t, err)
+	removed := models.StateDeleted
+	_, err = urlCtrl.model.Update(deleted.Key, "", 0, models.UrlChanges{State: &removed})
+	require.NoError(t, err)
+	for _, item := range []*models.Url{scheduled, deleted} {
+		req, _ = http.NewRequest("GET", "/p/"+item.Key, nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		page = PreviewPage{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.False(t, page.Available)
+		assert.Empty(t, page.Origin)
+		assert.Empty(t, page.Title)
+		req.Header.Set("Accept", "text/html")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.NotContains(t, w.Body.String(), item.Origin)
+	}
+
+	log.Debug("Interstitial link and flagged domain show the preview before redirecting")
+	shown, err := urlCtrl.model.GenerateWithOptions("http://preview.com/always", models.GenerateOptions{Interstitial: true})
+	require.NoError(t, err)
+	viper.Set(keyPreviewDomains, []string{"flagged.com"})
+	defer viper.Set(keyPreviewDomains, nil)
+	domain, err := urlCtrl.model.GenerateWithOptions("http://www.flagged.com/", models.GenerateOptions{})
+	require.NoError(t, err)
+	for _, item := range []*models.Url{shown, domain} {
+		req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+		req.Header.Set("Accept", "text/html")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), item.Origin)
+		req, _ = http.NewRequest("GET", "/r/"+item.Key, nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		page = PreviewPage{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.Equal(t, item.Origin, page.Origin)
+		req, _ = http.NewRequest("GET", "/r/"+item.Key+"?continue=1", nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, item.Origin, w.Header().Get("Location"))
+	}
+	assert.Contains(t, newPreviewPage(domain).Warning, "domain has been flagged")
+
+	log.Debug("Unknown code renders the not found page for browsers")
+	req, _ = http.NewRequest("GET", "/r/non-exists", nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Link not found")
+}
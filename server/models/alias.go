@@ -0,0 +1,74 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	keyAliasCharset   = "alias.charset"
+	keyAliasMinLength = "alias.minLength"
+	keyAliasMaxLength = "alias.maxLength"
+	keyAliasReserved  = "alias.reserved"
+)
+
+var (
+	ErrAliasInvalid  = errors.New("Alias is invalid")
+	ErrAliasReserved = errors.New("Alias is reserved")
+	ErrAliasTaken    = errors.New("Alias is already taken")
+)
+
+// defaultReservedAliases are the words never accepted as alias, since they
+// clash with routes or could mislead users. The alias.reserved config extends them.
+var defaultReservedAliases = []string{
+	"admin", "api", "create", "shorten", "static", "r", "p", "qr", "links",
+	"login", "logout", "signup", "account", "settings", "health", "status",
+	"well-known", "assets", "www", "help", "about",
+}
+
+// aliasPatterns caches the compiled charset patterns
+var aliasPatterns sync.Map
+
+func init() {
+	viper.SetDefault(keyAliasCharset, "A-Za-z0-9_-")
+	viper.SetDefault(keyAliasMinLength, 3)
+	viper.SetDefault(keyAliasMaxLength, 64)
+}
+
+// ValidAlias checks an alias against the configured charset and length
+func ValidAlias(alias string) bool {
+	length := utf8.RuneCountInString(alias)
+	if length < viper.GetInt(keyAliasMinLength) || length > viper.GetInt(keyAliasMaxLength) {
+		return false
+	}
+
+	charset := viper.GetString(keyAliasCharset)
+	pattern, ok := aliasPatterns.Load(charset)
+	if !ok {
+		compiled, err := regexp.Compile(strings.Join([]string{"^[", charset, "]+$"}, ""))
+		if err != nil {
+			return false
+		}
+		pattern, _ = aliasPatterns.LoadOrStore(charset, compiled)
+	}
+
+	return pattern.(*regexp.Regexp).MatchString(alias)
+}
+
+// IsReservedAlias reports whether an alias is one of the reserved words,
+// regardless of its case
+func IsReservedAlias(alias string) bool {
+	reserved := append(defaultReservedAliases, viper.GetStringSlice(keyAliasReserved)...)
+	for _, word := range reserved {
+		if strings.EqualFold(word, alias) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	keyClicksBufferSize    = "clicks.bufferSize"
+	keyClicksBatchSize     = "clicks.batchSize"
+	keyClicksFlushInterval = "clicks.flushInterval"
+)
+
+// Device types of a click
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceBot     = "bot"
+)
+
+// ClickEvent is a single redirect through a short code. Bot clicks are kept
+// for audit, but left out of the human counts.
+type ClickEvent struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Code           string    `gorm:"index:idx_click_events_code_created;size:191;not null" json:"code"`
+	CreatedAt      time.Time `gorm:"index:idx_click_events_code_created" json:"created_at"`
+	Referrer       string    `gorm:"size:2048" json:"referrer"`
+	Browser        string    `gorm:"size:64" json:"browser"`
+	BrowserVersion string    `gorm:"size:64" json:"browser_version"`
+	OS             string    `gorm:"size:64" json:"os"`
+	Device         string    `gorm:"size:16" json:"device"`
+	IP             string    `gorm:"size:45" json:"ip"`
+	Country        string    `gorm:"size:2" json:"country"`
+	City           string    `gorm:"size:128" json:"city"`
+	Bot            bool      `gorm:"index;default:0" json:"bot"`
+	BotReason      string    `gorm:"size:32" json:"bot_reason,omitempty"`
+	Rule           string    `gorm:"size:64" json:"rule,omitempty"`    // Redirect rule matched by the click
+	Variant        string    `gorm:"size:64" json:"variant,omitempty"` // Variant of the split chosen for the click
+	Source         string    `gorm:"size:16" json:"source,omitempty"`  // Marker of the short url, like qr for the scans
+}
+
+// AnonymizeIP drops the host part of an address, the last byte of an ipv4
+// and the last 80 bits of an ipv6
+func AnonymizeIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// ClickWriter stores click events from a buffer, by batches. Writing never
+// blocks: events coming while the buffer is full are dropped and counted.
+type ClickWriter struct {
+	db       *gorm.DB
+	log      *zap.Logger
+	events   chan ClickEvent
+	size     int
+	interval time.Duration
+	dropped  uint64
+}
+
+func init() {
+	viper.SetDefault(keyClicksBufferSize, 10000)
+	viper.SetDefault(keyClicksBatchSize, 100)
+	viper.SetDefault(keyClicksFlushInterval, time.Second)
+}
+
+func NewClickWriter(log *zap.Logger, db *gorm.DB) (*ClickWriter, error) {
+	if err := db.AutoMigrate(&ClickEvent{}, &ClickRollup{}, &ClickDimensionRollup{}); err != nil {
+		return nil, errors.Wrap(err, "db.AutoMigrate")
+	}
+
+	size := viper.GetInt(keyClicksBatchSize)
+	if size <= 0 {
+		size = 100
+	}
+
+	return &ClickWriter{
+		db:       db,
+		log:      log,
+		events:   make(chan ClickEvent, viper.GetInt(keyClicksBufferSize)),
+		size:     size,
+		interval: viper.GetDuration(keyClicksFlushInterval),
+	}, nil
+}
+
+// Write queues an event, it reports false when the event was dropped
+func (w *ClickWriter) Write(event ClickEvent) bool {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	select {
+	case w.events <- event:
+		return true
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped since the writer started
+func (w *ClickWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Run stores the queued events until the context is done, then stores the
+// events left in the buffer
+func (w *ClickWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var (
+		batch    = make([]ClickEvent, 0, w.size)
+		reported uint64
+	)
+	flush := func() {
+		if len(batch) != 0 {
+			if err := w.store(batch); err != nil {
+				w.log.With(zap.Error(err), zap.Int("events", len(batch))).Error("w.store")
+			}
+			batch = batch[:0]
+		}
+
+		if dropped := w.Dropped(); dropped != reported {
+			w.log.With(zap.Uint64("dropped", dropped-reported)).Warn("click buffer is full, events dropped")
+			reported = dropped
+		}
+	}
+
+	for {
+		select {
+		case event := <-w.events:
+			batch = append(batch, event)
+			if len(batch) >= w.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-w.events:
+					batch = append(batch, event)
+					if len(batch) >= w.size {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// store writes a batch of events along with their rollups
+func (w *ClickWriter) store(batch []ClickEvent) error {
+	return w.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(batch, w.size).Error; err != nil {
+			return errors.Wrap(err, "tx.CreateInBatches")
+		}
+
+		return rollupClicks(tx, batch)
+	})
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	assert.Equal(t, "203.0.113.0", AnonymizeIP(net.ParseIP("203.0.113.42")))
+	assert.Equal(t, "2001:db8:85a3::", AnonymizeIP(net.ParseIP("2001:db8:85a3:8d3:1319:8a2e:370:7348")))
+	assert.Equal(t, "", AnonymizeIP(nil))
+}
+
+func TestClickWriter(t *testing.T) {
+	log := libs.InitLogging()
+	viper.Set(keyClicksBufferSize, 3)
+	viper.Set(keyClicksBatchSize, 2)
+	defer func() {
+		viper.Set(keyClicksBufferSize, 10000)
+		viper.Set(keyClicksBatchSize, 100)
+	}()
+
+	db, err := gorm.Open(sqlite.Open("click_test.db"))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.Remove("click_test.db"))
+	}()
+
+	writer, err := NewClickWriter(log, db)
+	require.NoError(t, err)
+
+	log.Debug("Events coming while the buffer is full are dropped")
+	for i := 0; i < 5; i++ {
+		writer.Write(ClickEvent{Code: "abc", Device: DeviceDesktop})
+	}
+	assert.Equal(t, uint64(2), writer.Dropped())
+
+	log.Debug("Buffered events are stored when the writer stops")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	writer.Run(ctx)
+
+	var count int64
+	require.NoError(t, db.Model(&ClickEvent{}).Where("code = ?", "abc").Count(&count).Error)
+	assert.Equal(t, int64(3), count)
+}
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	keyCodegenStrategy         = "codegen.strategy"
+	keyCodegenAlphabet         = "codegen.alphabet"
+	keyCodegenExcludeAmbiguous = "codegen.excludeAmbiguous"
+	keyCodegenMinLength        = "codegen.minLength"
+	keyCodegenSecret           = "codegen.secret"
+	keyCodegenBits             = "codegen.bits"
+)
+
+const (
+	// StrategySequential encodes the row id, codes follow each other
+	StrategySequential = "sequential"
+	// StrategyRandom draws random codes, retrying on collision
+	StrategyRandom = "random"
+	// StrategyObfuscated encodes a keyed permutation of the row id
+	StrategyObfuscated = "obfuscated"
+)
+
+const (
+	// DefaultAlphabet is the base62 alphabet codes were always generated with
+	DefaultAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// ambiguousCharacters are hard to tell apart once printed
+	ambiguousCharacters = "0O1lI"
+
+	// Length of random codes when no minimum length is configured
+	defaultRandomLength = 7
+
+	// Number of rounds of the feistel network
+	feistelRounds = 4
+)
+
+// CodeGenerator turns the id of a new row into its short code
+type CodeGenerator interface {
+	// Code returns the short code of the row id. Attempt counts the codes
+	// previously refused for this row because they were already taken.
+	Code(id uint64, attempt int) (string, error)
+}
+
+// Alphabet is the set of characters short codes are made of
+type Alphabet string
+
+// NewAlphabet returns the alphabet of 'chars', optionally without the
+// characters which are easily confused with each other
+func NewAlphabet(chars string, excludeAmbiguous bool) (Alphabet, error) {
+	var b strings.Builder
+	for _, c := range chars {
+		if excludeAmbiguous && strings.ContainsRune(ambiguousCharacters, c) {
+			continue
+		}
+		if strings.ContainsRune(b.String(), c) {
+			return "", errors.Errorf("alphabet has duplicated character %q", c)
+		}
+		if c > 127 {
+			return "", errors.Errorf("alphabet has non ascii character %q", c)
+		}
+		b.WriteRune(c)
+	}
+
+	if b.Len() < 2 {
+		return "", errors.New("alphabet must have at least 2 characters")
+	}
+
+	return Alphabet(b.String()), nil
+}
+
+// Encode writes n in the alphabet base, left padded to minLength
+func (a Alphabet) Encode(n uint64, minLength int) string {
+	base := uint64(len(a))
+	var b []byte
+	for n > 0 {
+		b = append(b, a[n%base])
+		n /= base
+	}
+
+	for len(b) < minLength {
+		b = append(b, a[0])
+	}
+
+	// Digits were appended from the least significant
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return string(b)
+}
+
+// SequentialGenerator encodes the row id shifted by an offset
+type SequentialGenerator struct {
+	Alphabet  Alphabet
+	MinLength int
+	Offset    uint64
+}
+
+func (g SequentialGenerator) Code(id uint64, attempt int) (string, error) {
+	return g.Alphabet.Encode(id+g.Offset, g.MinLength), nil
+}
+
+// RandomGenerator draws codes with a cryptographically secure source. Codes
+// grow by one character every two refused attempts to escape a crowded space.
+type RandomGenerator struct {
+	Alphabet Alphabet
+	Length   int
+}
+
+func (g RandomGenerator) Code(id uint64, attempt int) (string, error) {
+	length := g.Length + attempt/2
+	max := big.NewInt(int64(len(g.Alphabet)))
+
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "rand.Int")
+		}
+		b[i] = g.Alphabet[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
+// ObfuscatedGenerator encodes a keyed feistel permutation of the row id.
+// Since the permutation is a bijection over ids lower than 2^Bits, codes never
+// collide while giving away neither the order nor the volume of links.
+type ObfuscatedGenerator struct {
+	Alphabet  Alphabet
+	MinLength int
+	Bits      uint
+	Secret    []byte
+}
+
+func (g ObfuscatedGenerator) Code(id uint64, attempt int) (string, error) {
+	if g.Bits%2 != 0 || g.Bits < 8 || g.Bits > 64 {
+		return "", errors.Errorf("bits must be an even number between 8 and 64, got %d", g.Bits)
+	}
+
+	if g.Bits < 64 && id >= 1<<g.Bits {
+		return "", errors.Errorf("id %d is out of the %d bits obfuscation domain", id, g.Bits)
+	}
+
+	return g.Alphabet.Encode(g.permute(id), g.MinLength), nil
+}
+
+func (g ObfuscatedGenerator) permute(id uint64) uint64 {
+	half := g.Bits / 2
+	mask := uint64(1)<<half - 1
+	left, right := id>>half&mask, id&mask
+
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^(g.round(round, right)&mask)
+	}
+
+	return left<<half | right
+}
+
+// round is the keyed function of the feistel network
+func (g ObfuscatedGenerator) round(round int, value uint64) uint64 {
+	mac := hmac.New(sha256.New, g.Secret)
+	buf := make([]byte, 9)
+	buf[0] = byte(round)
+	binary.BigEndian.PutUint64(buf[1:], value)
+	mac.Write(buf)
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func init() {
+	viper.SetDefault(keyCodegenStrategy, StrategySequential)
+	viper.SetDefault(keyCodegenAlphabet, DefaultAlphabet)
+	viper.SetDefault(keyCodegenBits, 40)
+}
+
+// NewCodeGeneratorFromViper builds the code generator picked by configuration
+func NewCodeGeneratorFromViper() (CodeGenerator, error) {
+	alphabet, err := NewAlphabet(viper.GetString(keyCodegenAlphabet), viper.GetBool(keyCodegenExcludeAmbiguous))
+	if err != nil {
+		return nil, errors.Wrap(err, keyCodegenAlphabet)
+	}
+
+	minLength := viper.GetInt(keyCodegenMinLength)
+	switch strategy := viper.GetString(keyCodegenStrategy); strategy {
+	case StrategySequential:
+		return SequentialGenerator{
+			Alphabet:  alphabet,
+			MinLength: minLength,
+			Offset:    idBuffer,
+		}, nil
+	case StrategyRandom:
+		if minLength == 0 {
+			minLength = defaultRandomLength
+		}
+		return RandomGenerator{
+			Alphabet: alphabet,
+			Length:   minLength,
+		}, nil
+	case StrategyObfuscated:
+		secret := viper.GetString(keyCodegenSecret)
+		if len(secret) == 0 {
+			return nil, errors.New(keyCodegenSecret + " must be provided for obfuscated codes")
+		}
+		generator := ObfuscatedGenerator{
+			Alphabet:  alphabet,
+			MinLength: minLength,
+			Bits:      viper.GetUint(keyCodegenBits),
+			Secret:    []byte(secret),
+		}
+		if _, err := generator.Code(0, 0); err != nil {
+			return nil, errors.Wrap(err, keyCodegenBits)
+		}
+		return generator, nil
+	default:
+		return nil, errors.Errorf("unknown %s %q", keyCodegenStrategy, strategy)
+	}
+}
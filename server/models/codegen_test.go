@@ -0,0 +1,91 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeGenerator(t *testing.T) {
+	alphabet, err := NewAlphabet(DefaultAlphabet, false)
+	require.NoError(t, err)
+
+	// Sequential codes are the historical base62 codes, without the uint32 overflow
+	sequential := SequentialGenerator{Alphabet: alphabet, Offset: idBuffer}
+	code, err := sequential.Code(1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "KyjB", code)
+	code, err = sequential.Code(1<<32-1-idBuffer, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "4gfFC3", code)
+	wrapped, err := sequential.Code(1<<32-idBuffer, 0)
+	require.NoError(t, err)
+	assert.NotEqual(t, "0", wrapped)
+	assert.Greater(t, wrapped, code)
+
+	// Minimum length pads codes
+	sequential.MinLength = 8
+	code, err = sequential.Code(1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "0000KyjB", code)
+
+	// Ambiguous characters are excluded
+	clear, err := NewAlphabet(DefaultAlphabet, true)
+	require.NoError(t, err)
+	assert.Len(t, string(clear), 57)
+	random := RandomGenerator{Alphabet: clear, Length: 7}
+	for i := 0; i < 100; i++ {
+		code, err := random.Code(0, 0)
+		require.NoError(t, err)
+		assert.Len(t, code, 7)
+		assert.False(t, strings.ContainsAny(code, ambiguousCharacters))
+	}
+
+	// Random codes grow after refused attempts
+	code, err = random.Code(0, 4)
+	require.NoError(t, err)
+	assert.Len(t, code, 9)
+
+	// Obfuscated codes are a bijection of the id
+	obfuscated := ObfuscatedGenerator{Alphabet: alphabet, Bits: 40, Secret: []byte("secret"), MinLength: 7}
+	seen := map[string]uint64{}
+	var ascending int
+	var previous string
+	for id := uint64(0); id < 10000; id++ {
+		code, err := obfuscated.Code(id, 0)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, len(code), 7)
+		_, exists := seen[code]
+		require.False(t, exists, "code %s generated twice", code)
+		seen[code] = id
+		if code > previous {
+			ascending++
+		}
+		previous = code
+	}
+	assert.Less(t, ascending, 6000, "obfuscated codes should not follow the ids")
+
+	// Another secret gives other codes
+	other := obfuscated
+	other.Secret = []byte("other")
+	a, _ := obfuscated.Code(42, 0)
+	b, _ := other.Code(42, 0)
+	assert.NotEqual(t, a, b)
+
+	// Ids out of the domain are refused
+	_, err = obfuscated.Code(1<<40, 0)
+	require.Error(t, err)
+
+	// Configuration picks the strategy
+	viper.Set(keyCodegenStrategy, StrategyObfuscated)
+	_, err = NewCodeGeneratorFromViper()
+	require.Error(t, err)
+	viper.Set(keyCodegenSecret, "secret")
+	generator, err := NewCodeGeneratorFromViper()
+	require.NoError(t, err)
+	assert.IsType(t, ObfuscatedGenerator{}, generator)
+	viper.Set(keyCodegenStrategy, StrategySequential)
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPorts are dropped from normalized urls
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeUrl returns the canonical form of a destination, so that spellings
+// of the same destination compare equal: lower-cased scheme and host, no
+// default port, a root path and sorted query parameters.
+func NormalizeUrl(raw string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", errors.Wrap(err, "url.Parse")
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	host := strings.ToLower(parsed.Hostname())
+	if port := parsed.Port(); len(port) != 0 && port != defaultPorts[parsed.Scheme] {
+		host = strings.Join([]string{host, port}, ":")
+	}
+	parsed.Host = host
+
+	if len(parsed.Path) == 0 {
+		parsed.Path = "/"
+	}
+
+	// Encode sorts the parameters by key
+	parsed.RawQuery = parsed.Query().Encode()
+
+	return parsed.String(), nil
+}
+
+// HashOrigin returns the hash of the normalized destination, indexed to find
+// the links pointing to the same destination
+func HashOrigin(origin string) string {
+	normalized, err := NormalizeUrl(origin)
+	if err != nil {
+		normalized = origin
+	}
+
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindReusable looks up an active generated link of the same owner pointing
+// to the same destination with identical settings. ErrNotFound is returned
+// when a new link has to be created.
+func (u *UrlModel) FindReusable(origin string, opts GenerateOptions) (*Url, error) {
+	// Aliased, protected, limited, scheduled, routed, split and app links are created on purpose, they are never shared
+	if len(opts.Alias) != 0 || len(opts.Password) != 0 || opts.MaxClicks != 0 || opts.ActiveFrom != nil ||
+		len(opts.Rules) != 0 || len(opts.Variants) != 0 || opts.DeepLink != (DeepLink{}) {
+		return nil, ErrNotFound
+	}
+
+	normalized, err := NormalizeUrl(origin)
+	if err != nil {
+		return nil, errors.Wrap(err, "NormalizeUrl")
+	}
+
+	query := u.db.Model(&Url{}).
+		Where("origin_hash = ? AND owner = ? AND custom = ? AND protected = ? AND state = ?",
+			HashOrigin(origin), opts.Owner, false, false, StateActive).
+		Where("max_clicks IS NULL AND active_from IS NULL AND rules IS NULL AND variants IS NULL").
+		Where(map[string]interface{}{
+			"deeplink_ios":           "",
+			"deeplink_ios_store":     "",
+			"deeplink_android":       "",
+			"deeplink_android_store": "",
+			"deeplink_web":           "",
+		}).
+		Where("redirect_type = ? AND query_passthrough = ?", opts.RedirectType, opts.QueryPassthrough).
+		Where("title = ? AND interstitial = ?", opts.Title, opts.Interstitial).
+		Where(map[string]interface{}{
+			"utm_source":   opts.Utm.Source,
+			"utm_medium":   opts.Utm.Medium,
+			"utm_campaign": opts.Utm.Campaign,
+			"utm_term":     opts.Utm.Term,
+			"utm_content":  opts.Utm.Content,
+		})
+	if opts.Expire != nil {
+		query = query.Where("expiry = ?", opts.Expire)
+	} else {
+		query = query.Where("expiry IS NULL")
+	}
+
+	var candidates []Url
+	if result := query.Order("id").Find(&candidates); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "query.Find")
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Expiry != nil && time.Now().After(*candidate.Expiry) {
+			continue
+		}
+
+		// Guard against hash collisions
+		if candidateNormalized, err := NormalizeUrl(candidate.Origin); err != nil || candidateNormalized != normalized {
+			continue
+		}
+
+		return &candidate, nil
+	}
+
+	return nil, ErrNotFound
+}
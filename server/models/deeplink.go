@@ -0,0 +1,86 @@
+package models
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mobile platforms of the deep links
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+)
+
+var (
+	ErrInvalidDeepLink = errors.New("Invalid Deep Link")
+)
+
+// unsafeSchemes run code in the page instead of opening an app
+var unsafeSchemes = map[string]bool{
+	"javascript": true,
+	"vbscript":   true,
+	"data":       true,
+	"file":       true,
+	"blob":       true,
+}
+
+// DeepLink opens the app of an item on the mobiles it is set up for, the
+// visitors without the app go to the store, then to the web fallback
+type DeepLink struct {
+	// Ios is the custom scheme url or the universal link opening the iOS app
+	Ios      string `gorm:"size:2048;not null;default:''" json:"ios,omitempty"`
+	IosStore string `gorm:"size:2048;not null;default:''" json:"ios_store,omitempty"`
+	// Android is the intent uri or the custom scheme url opening the Android app
+	Android      string `gorm:"size:2048;not null;default:''" json:"android,omitempty"`
+	AndroidStore string `gorm:"size:2048;not null;default:''" json:"android_store,omitempty"`
+	// Web is the fallback without store, the destination of the visitor when empty
+	Web string `gorm:"size:2048;not null;default:''" json:"web,omitempty"`
+}
+
+// Handoff returns the app url of a platform and the url visitors fall back
+// to without the app. The app url is empty when the item opens no app on the
+// platform.
+func (d DeepLink) Handoff(platform, destination string) (app, fallback string) {
+	store := ""
+	switch platform {
+	case PlatformIOS:
+		app, store = d.Ios, d.IosStore
+	case PlatformAndroid:
+		app, store = d.Android, d.AndroidStore
+	}
+
+	switch {
+	case len(app) == 0:
+		return "", ""
+	case len(store) != 0:
+		return app, store
+	case len(d.Web) != 0:
+		return app, d.Web
+	}
+
+	return app, destination
+}
+
+// ValidAppUrl reports whether a url opens an app, scripts and local files
+// are refused as they would run in the handoff page
+func ValidAppUrl(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil || len(parsed.Scheme) == 0 {
+		return false
+	}
+
+	return !unsafeSchemes[strings.ToLower(parsed.Scheme)]
+}
+
+// validateDeepLink checks the app urls of an item
+func validateDeepLink(d DeepLink) error {
+	for _, app := range []string{d.Ios, d.Android} {
+		if len(app) != 0 && !ValidAppUrl(app) {
+			return errors.Wrapf(ErrInvalidDeepLink, "%q does not open an app", app)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	keyHitsFlushInterval = "hits.flushInterval"
+	keyHitsBatchSize     = "hits.batchSize"
+)
+
+const (
+	// hitsPendingSet holds the codes hit since their last flush
+	hitsPendingSet = "hits-pending"
+	// hitsInflightSet holds the codes whose hits are being written to the database
+	hitsInflightSet = "hits-inflight"
+	// hitsFlushLock keeps a single instance flushing at a time
+	hitsFlushLock = "hits-flush-lock"
+)
+
+func pendingHitsKey(code string) string {
+	return strings.Join([]string{"hits", code}, "-")
+}
+
+func inflightHitsKey(code string) string {
+	return strings.Join([]string{"hits-inflight", code}, "-")
+}
+
+// moveHitsScript moves the pending hits of a code to its inflight counter, so
+// hits counted meanwhile wait for the next flush
+var moveHitsScript = redis.NewScript(`
+local hits = redis.call('GET', KEYS[1])
+if hits then
+	redis.call('INCRBY', KEYS[2], hits)
+	redis.call('DEL', KEYS[1])
+end
+redis.call('SREM', KEYS[3], ARGV[1])
+redis.call('SADD', KEYS[4], ARGV[1])
+return 1
+`)
+
+// Hit counts a hit in redis, it reaches the database on the next flush
+func (u *UrlModel) Hit(shortCode string) error {
+	ctx := context.Background()
+	if _, err := u.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, pendingHitsKey(shortCode))
+		pipe.SAdd(ctx, hitsPendingSet, shortCode)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "u.redis.TxPipelined")
+	}
+
+	return nil
+}
+
+// mergePendingHits adds the hits not flushed yet to the items
+func (u *UrlModel) mergePendingHits(items []*Url) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, 2*len(items))
+	for _, item := range items {
+		keys = append(keys, pendingHitsKey(item.Key), inflightHitsKey(item.Key))
+	}
+
+	values, err := u.redis.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return errors.Wrap(err, "u.redis.MGet")
+	}
+
+	for i, value := range values {
+		if hits := parseHits(value); hits > 0 {
+			items[i/2].Hits += hits
+		}
+	}
+
+	return nil
+}
+
+func parseHits(value interface{}) uint {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+
+	hits, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return uint(hits)
+}
+
+// HitFlusher writes the hits counted in redis to the database by batches.
+// Hits stay in redis until their batch is committed, so a failed flush is
+// retried by the next one: a hit is never lost, but may be counted twice if
+// an instance dies right after a commit.
+type HitFlusher struct {
+	redis     *redis.Client
+	db        *gorm.DB
+	log       *zap.Logger
+	interval  time.Duration
+	batchSize int
+}
+
+func init() {
+	viper.SetDefault(keyHitsFlushInterval, 10*time.Second)
+	viper.SetDefault(keyHitsBatchSize, 100)
+}
+
+func NewHitFlusher(log *zap.Logger, redis *redis.Client, db *gorm.DB) *HitFlusher {
+	batchSize := viper.GetInt(keyHitsBatchSize)
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	return &HitFlusher{
+		redis:     redis,
+		db:        db,
+		log:       log,
+		interval:  viper.GetDuration(keyHitsFlushInterval),
+		batchSize: batchSize,
+	}
+}
+
+// Run flushes the hits periodically until the context is done
+func (f *HitFlusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Flush(ctx); err != nil {
+				f.log.With(zap.Error(err)).Error("f.Flush")
+			}
+		}
+	}
+}
+
+// Flush writes every pending hit to the database
+func (f *HitFlusher) Flush(ctx context.Context) error {
+	token, err := acquireLock(ctx, f.redis, hitsFlushLock, f.lockTTL())
+	if err != nil {
+		return err
+	}
+	if len(token) == 0 {
+		// Another instance is flushing
+		return nil
+	}
+	defer func() {
+		if err := releaseLock(context.Background(), f.redis, hitsFlushLock, token); err != nil {
+			f.log.With(zap.Error(err)).Error("releaseLock")
+		}
+	}()
+
+	pending, err := f.redis.SMembers(ctx, hitsPendingSet).Result()
+	if err != nil {
+		return errors.Wrap(err, "f.redis.SMembers")
+	}
+
+	for _, code := range pending {
+		keys := []string{pendingHitsKey(code), inflightHitsKey(code), hitsPendingSet, hitsInflightSet}
+		if err := moveHitsScript.Run(ctx, f.redis, keys, code).Err(); err != nil {
+			return errors.Wrap(err, "moveHitsScript.Run")
+		}
+	}
+
+	// Codes left over by a failed flush are written along the new ones
+	inflight, err := f.redis.SMembers(ctx, hitsInflightSet).Result()
+	if err != nil {
+		return errors.Wrap(err, "f.redis.SMembers")
+	}
+
+	for start := 0; start < len(inflight); start += f.batchSize {
+		end := start + f.batchSize
+		if end > len(inflight) {
+			end = len(inflight)
+		}
+
+		// Keep the lock for the next batch, the flush stops once another
+		// instance took it over
+		held, err := extendLock(ctx, f.redis, hitsFlushLock, token, f.lockTTL())
+		if err != nil {
+			return err
+		}
+		if !held {
+			f.log.Warn("Flush lock lost, stopping")
+			return nil
+		}
+
+		if err := f.flushBatch(ctx, inflight[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushBatch writes the inflight hits of the codes in a single transaction,
+// then forgets them
+func (f *HitFlusher) flushBatch(ctx context.Context, codes []string) error {
+	keys := make([]string, len(codes))
+	for i, code := range codes {
+		keys[i] = inflightHitsKey(code)
+	}
+
+	values, err := f.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return errors.Wrap(err, "f.redis.MGet")
+	}
+
+	if err := f.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, code := range codes {
+			hits := parseHits(values[i])
+			if hits == 0 {
+				continue
+			}
+
+			if result := tx.Model(&Url{}).Where("`key` = ?", code).
+				UpdateColumn("hits", gorm.Expr("hits + ?", hits)); result.Error != nil {
+				return errors.Wrap(result.Error, "tx.UpdateColumn")
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "f.db.Transaction")
+	}
+
+	members := make([]interface{}, len(codes))
+	cacheKeys := make([]string, len(codes))
+	for i, code := range codes {
+		members[i] = code
+		cacheKeys[i] = Url{Key: code}.GetCacheKey()
+	}
+
+	// Cached items hold the hits of their last database read
+	if _, err := f.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.SRem(ctx, hitsInflightSet, members...)
+		pipe.Del(ctx, cacheKeys...)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "f.redis.TxPipelined")
+	}
+
+	return nil
+}
+
+// lockTTL releases the lock of an instance dying while flushing
+func (f *HitFlusher) lockTTL() time.Duration {
+	if f.interval < time.Minute {
+		return time.Minute
+	}
+
+	return f.interval
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	keyIdAllocBackend   = "idalloc.backend"
+	keyIdAllocBlockSize = "idalloc.blockSize"
+)
+
+const (
+	// BackendRedis reserves id blocks with INCRBY on a redis counter
+	BackendRedis = "redis"
+	// BackendDatabase reserves id blocks from a sequence table
+	BackendDatabase = "database"
+
+	// urlSequence names the sequence of the url ids
+	urlSequence = "urls"
+)
+
+// BlockSource reserves blocks of ids shared by every instance
+type BlockSource interface {
+	// Reserve returns the last id of a new block of 'size' ids
+	Reserve(ctx context.Context, size uint64) (uint64, error)
+	// Floor makes sure no id lower than or equal to 'id' is reserved anymore
+	Floor(ctx context.Context, id uint64) error
+}
+
+// IDAllocator hands out ids from blocks reserved in a shared source. Each
+// instance only reaches the source once per block, and two instances never
+// get the same id.
+type IDAllocator struct {
+	source BlockSource
+	size   uint64
+
+	mu   sync.Mutex
+	next uint64
+	last uint64
+}
+
+func NewIDAllocator(source BlockSource, size uint64) *IDAllocator {
+	if size == 0 {
+		size = 1
+	}
+
+	return &IDAllocator{source: source, size: size}
+}
+
+// Next returns a new id
+func (a *IDAllocator) Next(ctx context.Context) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.next == 0 || a.next > a.last {
+		last, err := a.source.Reserve(ctx, a.size)
+		if err != nil {
+			return 0, errors.Wrap(err, "source.Reserve")
+		}
+		a.next, a.last = last-a.size+1, last
+	}
+
+	id := a.next
+	a.next++
+	return id, nil
+}
+
+// floorScript raises the counter to at least ARGV[1]
+var floorScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// RedisBlockSource reserves blocks with INCRBY on a counter
+type RedisBlockSource struct {
+	client *redis.Client
+	key    string
+}
+
+func NewRedisBlockSource(client *redis.Client, sequence string) *RedisBlockSource {
+	return &RedisBlockSource{
+		client: client,
+		key:    strings.Join([]string{"sequence", sequence}, "-"),
+	}
+}
+
+func (s *RedisBlockSource) Reserve(ctx context.Context, size uint64) (uint64, error) {
+	last, err := s.client.IncrBy(ctx, s.key, int64(size)).Uint64()
+	if err != nil {
+		return 0, errors.Wrap(err, "client.IncrBy")
+	}
+
+	return last, nil
+}
+
+func (s *RedisBlockSource) Floor(ctx context.Context, id uint64) error {
+	if err := floorScript.Run(ctx, s.client, []string{s.key}, id).Err(); err != nil {
+		return errors.Wrap(err, "floorScript.Run")
+	}
+
+	return nil
+}
+
+// IDSequence is a row of the sequence table
+type IDSequence struct {
+	Name  string `gorm:"primaryKey;size:64"`
+	Value uint64 `gorm:"not null;default:0"`
+}
+
+// DatabaseBlockSource reserves blocks from a row of the sequence table. The
+// row lock taken by the UPDATE serializes concurrent reservations.
+type DatabaseBlockSource struct {
+	db   *gorm.DB
+	name string
+}
+
+func NewDatabaseBlockSource(db *gorm.DB, sequence string) (*DatabaseBlockSource, error) {
+	if err := db.AutoMigrate(&IDSequence{}); err != nil {
+		return nil, errors.Wrap(err, "db.AutoMigrate")
+	}
+
+	if err := db.Where(IDSequence{Name: sequence}).FirstOrCreate(&IDSequence{}).Error; err != nil {
+		return nil, errors.Wrap(err, "db.FirstOrCreate")
+	}
+
+	return &DatabaseBlockSource{db: db, name: sequence}, nil
+}
+
+func (s *DatabaseBlockSource) Reserve(ctx context.Context, size uint64) (uint64, error) {
+	var sequence IDSequence
+	if err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if result := tx.Model(&IDSequence{}).Where("name = ?", s.name).
+			UpdateColumn("value", gorm.Expr("value + ?", size)); result.Error != nil {
+			return errors.Wrap(result.Error, "tx.UpdateColumn")
+		}
+
+		if result := tx.Where("name = ?", s.name).First(&sequence); result.Error != nil {
+			return errors.Wrap(result.Error, "tx.First")
+		}
+
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "db.Transaction")
+	}
+
+	return sequence.Value, nil
+}
+
+func (s *DatabaseBlockSource) Floor(ctx context.Context, id uint64) error {
+	if result := s.db.WithContext(ctx).Model(&IDSequence{}).Where("name = ? AND value < ?", s.name, id).
+		UpdateColumn("value", id); result.Error != nil {
+		return errors.Wrap(result.Error, "db.UpdateColumn")
+	}
+
+	return nil
+}
+
+func init() {
+	viper.SetDefault(keyIdAllocBackend, BackendDatabase)
+	viper.SetDefault(keyIdAllocBlockSize, 100)
+}
+
+// NewIDAllocatorFromViper builds the url id allocator picked by configuration,
+// starting above the ids already in use
+func NewIDAllocatorFromViper(client *redis.Client, db *gorm.DB) (*IDAllocator, error) {
+	var source BlockSource
+	switch backend := viper.GetString(keyIdAllocBackend); backend {
+	case BackendRedis:
+		source = NewRedisBlockSource(client, urlSequence)
+	case BackendDatabase:
+		dbSource, err := NewDatabaseBlockSource(db, urlSequence)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewDatabaseBlockSource")
+		}
+		source = dbSource
+	default:
+		return nil, errors.Errorf("unknown %s %q", keyIdAllocBackend, backend)
+	}
+
+	var maxID uint64
+	if err := db.Model(&Url{}).Select("COALESCE(MAX(id), 0)").Scan(&maxID).Error; err != nil {
+		return nil, errors.Wrap(err, "db.Scan")
+	}
+
+	if err := source.Floor(context.Background(), maxID); err != nil {
+		return nil, errors.Wrap(err, "source.Floor")
+	}
+
+	return NewIDAllocator(source, viper.GetUint64(keyIdAllocBlockSize)), nil
+}
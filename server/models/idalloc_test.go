@@ -0,0 +1,134 @@
+package models
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+)
+
+func TestIDAllocator(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	source := NewRedisBlockSource(client, "test")
+	require.NoError(t, source.Floor(context.Background(), 41))
+
+	// Allocators sharing a source hand out distinct ids
+	allocators := []*IDAllocator{NewIDAllocator(source, 10), NewIDAllocator(source, 7)}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		ids = map[uint64]bool{}
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(a *IDAllocator) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := a.Next(context.Background())
+				require.NoError(t, err)
+				assert.Greater(t, id, uint64(41))
+
+				mu.Lock()
+				assert.False(t, ids[id], "id %d allocated twice", id)
+				ids[id] = true
+				mu.Unlock()
+			}
+		}(allocators[i%2])
+	}
+	wg.Wait()
+	assert.Len(t, ids, 800)
+
+	// The floor never lowers the counter
+	require.NoError(t, source.Floor(context.Background(), 1))
+	id, err := NewIDAllocator(source, 1).Next(context.Background())
+	require.NoError(t, err)
+	assert.Greater(t, id, uint64(800))
+}
+
+func TestConcurrentGenerate(t *testing.T) {
+	log := libs.InitLogging()
+
+	for _, backend := range []string{BackendDatabase, BackendRedis} {
+		log.Debug("Concurrent generate with " + backend + " backend")
+		viper.Set(keyIdAllocBackend, backend)
+		viper.Set(keyIdAllocBlockSize, 5)
+
+		db, err := gorm.Open(sqlite.Open("idalloc_test.db"))
+		require.NoError(t, err)
+
+		// SQLite allows a single writer
+		sqlDB, err := db.DB()
+		require.NoError(t, err)
+		sqlDB.SetMaxOpenConns(1)
+
+		mr, err := miniredis.Run()
+		require.NoError(t, err)
+
+		client := redis.NewClient(&redis.Options{
+			Addr: mr.Addr(),
+		})
+
+		// Rows created before the allocator existed are never reused
+		require.NoError(t, db.AutoMigrate(&Url{}))
+		require.NoError(t, db.Create(&Url{ID: 1000, Key: "legacy", Origin: "http://legacy.com"}).Error)
+
+		var instances []*UrlModel
+		for i := 0; i < 4; i++ {
+			model, err := NewUrlModel(log, client, db)
+			require.NoError(t, err)
+			instances = append(instances, model)
+		}
+
+		var (
+			mu   sync.Mutex
+			wg   sync.WaitGroup
+			keys = map[string]bool{}
+		)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(model *UrlModel) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					item, err := model.Generate("http://google.com", nil)
+					require.NoError(t, err)
+					assert.Greater(t, item.ID, 1000)
+
+					mu.Lock()
+					assert.False(t, keys[item.Key], "code %s generated twice", item.Key)
+					keys[item.Key] = true
+					mu.Unlock()
+				}
+			}(instances[i%len(instances)])
+		}
+		wg.Wait()
+		assert.Len(t, keys, 320)
+
+		var count int64
+		require.NoError(t, db.Model(&Url{}).Count(&count).Error)
+		assert.Equal(t, int64(321), count)
+
+		mr.Close()
+		require.NoError(t, sqlDB.Close())
+		require.NoError(t, os.Remove("idalloc_test.db"))
+	}
+
+	viper.Set(keyIdAllocBackend, BackendDatabase)
+	viper.Set(keyIdAllocBlockSize, 100)
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// jsonValue stores the value of a json column, empty values as NULL
+func jsonValue(v interface{}, empty bool) (driver.Value, error) {
+	if empty {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
+	}
+
+	return string(b), nil
+}
+
+// scanJSON reads a json column into dst, which is left as it is for NULL
+func scanJSON(value interface{}, dst interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return errors.Errorf("unsupported type %T for %T", value, dst)
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(b, dst), "json.Unmarshal")
+}
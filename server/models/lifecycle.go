@@ -0,0 +1,139 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotActive         = errors.New("Not Active Yet")
+	ErrPendingReview     = errors.New("Pending Review")
+	ErrFlagged           = errors.New("Flagged")
+	ErrDisabled          = errors.New("Disabled")
+	ErrBanned            = errors.New("Banned")
+	ErrTakenDown         = errors.New("Taken Down")
+	ErrInvalidTransition = errors.New("Invalid State Transition")
+)
+
+// LinkState is the lifecycle state of an item. Moderation states are stored
+// with the item, the others are evaluated from its times and clicks.
+type LinkState string
+
+const (
+	StateActive LinkState = "active"
+	// StatePendingReview items wait for a moderator before redirecting
+	StatePendingReview LinkState = "pending_review"
+	// StateFlagged items redirect through a warning page
+	StateFlagged LinkState = "flagged"
+	// StateDisabled items were disabled by an admin
+	StateDisabled LinkState = "disabled"
+	// StateDeleted items were deleted by their owner or an admin
+	StateDeleted LinkState = "deleted"
+	// StateBanned items were removed for abuse
+	StateBanned LinkState = "banned"
+	// StateTakenDown items were removed for legal reasons
+	StateTakenDown LinkState = "takedown"
+
+	// StateScheduled items are not active before their activation time
+	StateScheduled LinkState = "scheduled"
+	StateExpired   LinkState = "expired"
+	// StateExhausted items used every click allowed by MaxClicks
+	StateExhausted LinkState = "exhausted"
+)
+
+// stateTransitions are the moderation states an item can move to from each
+// moderation state
+var stateTransitions = map[LinkState][]LinkState{
+	StateActive:        {StatePendingReview, StateFlagged, StateDisabled, StateDeleted, StateBanned, StateTakenDown},
+	StatePendingReview: {StateActive, StateFlagged, StateDeleted, StateBanned, StateTakenDown},
+	StateFlagged:       {StateActive, StateDisabled, StateDeleted, StateBanned, StateTakenDown},
+	StateDisabled:      {StateActive, StateDeleted, StateBanned, StateTakenDown},
+	StateDeleted:       {StateActive, StateBanned, StateTakenDown},
+	StateBanned:        {StateActive, StateTakenDown},
+	StateTakenDown:     {StateActive},
+}
+
+// ownerStates are the only moderation states owners move their items between
+var ownerStates = map[LinkState]bool{
+	StateActive:  true,
+	StateDeleted: true,
+}
+
+// CanTransition reports whether an item can move between moderation states
+func CanTransition(from, to LinkState) bool {
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsModerationState reports whether a state is stored with the items
+func IsModerationState(state LinkState) bool {
+	_, ok := stateTransitions[state]
+	return ok
+}
+
+// stateOf returns the stored state of an item, derived from its status for
+// items cached before states existed
+func (u Url) stateOf() LinkState {
+	if len(u.State) != 0 {
+		return u.State
+	}
+
+	if !u.Status {
+		return StateDeleted
+	}
+
+	return StateActive
+}
+
+// Evaluate returns the lifecycle state of the item at a given time. Items
+// removed by moderation stay removed whatever their times, flagged items are
+// only flagged while they would otherwise redirect.
+func (u Url) Evaluate(now time.Time) LinkState {
+	state := u.stateOf()
+	if state != StateActive && state != StateFlagged {
+		return state
+	}
+
+	switch {
+	case u.Expiry != nil && now.After(*u.Expiry):
+		return StateExpired
+	case u.MaxClicks != nil && u.ClickCount >= *u.MaxClicks:
+		return StateExhausted
+	case u.ActiveFrom != nil && now.Before(*u.ActiveFrom):
+		return StateScheduled
+	}
+
+	return state
+}
+
+// Err returns the error of a lookup finding an item in this state
+func (s LinkState) Err() error {
+	switch s {
+	case StateActive:
+		return nil
+	case StateScheduled:
+		return ErrNotActive
+	case StatePendingReview:
+		return ErrPendingReview
+	case StateFlagged:
+		return ErrFlagged
+	case StateDisabled:
+		return ErrDisabled
+	case StateBanned:
+		return ErrBanned
+	case StateTakenDown:
+		return ErrTakenDown
+	}
+
+	return ErrExpired
+}
+
+func (u Url) IsExpired() bool {
+	return errors.Is(u.Evaluate(time.Now()).Err(), ErrExpired)
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// releaseLockScript removes a lock only while it still holds the token of
+// the instance, a lock which expired may be held by another one
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// extendLockScript renews a lock only while it still holds the token of the
+// instance
+var extendLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// acquireLock takes a lock shared by the instances, returning the token
+// releasing it or an empty token when another instance holds it
+func acquireLock(ctx context.Context, client *redis.Client, key string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "rand.Read")
+	}
+	token := hex.EncodeToString(b)
+
+	locked, err := client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "client.SetNX")
+	}
+	if !locked {
+		return "", nil
+	}
+
+	return token, nil
+}
+
+// extendLock renews a lock taken with the token, reporting whether the
+// instance still holds it
+func extendLock(ctx context.Context, client *redis.Client, key, token string, ttl time.Duration) (bool, error) {
+	extended, err := extendLockScript.Run(ctx, client, []string{key}, token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, errors.Wrap(err, "extendLockScript.Run")
+	}
+
+	return extended != 0, nil
+}
+
+// releaseLock removes a lock taken with the token
+func releaseLock(ctx context.Context, client *redis.Client, key, token string) error {
+	if err := releaseLockScript.Run(ctx, client, []string{key}, token).Err(); err != nil {
+		return errors.Wrap(err, "releaseLockScript.Run")
+	}
+
+	return nil
+}
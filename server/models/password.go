@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	keyPasswordMaxAttempts = "password.maxAttempts"
+	keyPasswordLockout     = "password.lockout"
+)
+
+var (
+	ErrPasswordRequired = errors.New("Password is required")
+	ErrPasswordInvalid  = errors.New("Password is invalid")
+	ErrTooManyAttempts  = errors.New("Too many failed attempts, try again later")
+)
+
+func init() {
+	viper.SetDefault(keyPasswordMaxAttempts, 5)
+	viper.SetDefault(keyPasswordLockout, 15*time.Minute)
+}
+
+func passwordFailuresKey(code string) string {
+	return strings.Join([]string{"password-failures", code}, "-")
+}
+
+// hashPassword returns the bcrypt hash of a link password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "bcrypt.GenerateFromPassword")
+	}
+
+	return string(hash), nil
+}
+
+// attemptScript counts an attempt before the password is compared, so
+// parallel guesses can't all pass the limit. The lockout window starts with
+// the first counted attempt and is never extended.
+var attemptScript = redis.NewScript(`
+local attempts = redis.call('INCR', KEYS[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return attempts
+`)
+
+// CheckPassword verifies the password of a protected item. Attempts are
+// counted by code and refunded when they succeed, once failures reach the
+// limit every attempt is refused until the lockout window is over.
+//
+// Counting by code lets anyone lock a link for one window by guessing, the
+// window is not extended by later guesses so the link always opens again.
+// Counting by visitor instead would let a botnet guess without limit.
+func (u *UrlModel) CheckPassword(item *Url, password string) error {
+	if !item.Protected {
+		return nil
+	}
+
+	if len(password) == 0 {
+		return ErrPasswordRequired
+	}
+
+	ctx := context.Background()
+	key := passwordFailuresKey(item.Key)
+	lockout := viper.GetDuration(keyPasswordLockout)
+	attempts, err := attemptScript.Run(ctx, u.redis, []string{key}, lockout.Milliseconds()).Int64()
+	if err != nil {
+		return errors.Wrap(err, "attemptScript.Run")
+	}
+	if attempts > viper.GetInt64(keyPasswordMaxAttempts) {
+		return ErrTooManyAttempts
+	}
+
+	// The hash is never cached, it is read from the database
+	var hash string
+	if result := u.db.Model(&Url{}).Select("password_hash").Where("`key` = ?", item.Key).Scan(&hash); result.Error != nil {
+		return errors.Wrap(result.Error, "u.db.Scan")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrPasswordInvalid
+	}
+
+	// Right passwords don't count as failures
+	if err := u.redis.Decr(ctx, key).Err(); err != nil {
+		return errors.Wrap(err, "u.redis.Decr")
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// keyPurgeTombstone keeps the codes of purged items from being issued again
+	keyPurgeTombstone = "purge.tombstone"
+	// keyPurgeRetentionDays purges the items deleted for longer, 0 disables it
+	keyPurgeRetentionDays = "purge.retentionDays"
+	keyPurgeInterval      = "purge.interval"
+)
+
+const (
+	// purgeLock keeps a single instance purging at a time
+	purgeLock = "purge-lock"
+	// Number of items read by each query of the retention job
+	purgeBatchSize = 100
+)
+
+var (
+	ErrNotDeleted = errors.New("Not Deleted")
+
+	// errNotPurged rolls back a purge whose item is no longer due
+	errNotPurged = errors.New("Not Purged")
+)
+
+// Tombstone reserves the code of a purged item
+type Tombstone struct {
+	Code      string    `gorm:"primaryKey;size:64"`
+	CodeFold  string    `gorm:"index;size:64"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+func init() {
+	viper.SetDefault(keyPurgeTombstone, true)
+	viper.SetDefault(keyPurgeRetentionDays, 0)
+	viper.SetDefault(keyPurgeInterval, time.Hour)
+}
+
+// Restore enables a deleted item again
+func (u *UrlModel) Restore(shortCode, actor string) (*Url, error) {
+	item, err := u.Get(shortCode, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if item.stateOf() != StateDeleted {
+		return nil, ErrNotDeleted
+	}
+
+	state := StateActive
+	return u.Update(shortCode, "", item.Version, UrlChanges{State: &state, Actor: actor, Reason: ReasonRestore})
+}
+
+// Purge removes an item for good, along with its clicks, stats and history.
+// The cache entry is removed within the database transaction, the other
+// counters kept in redis are removed afterwards.
+func (u *UrlModel) Purge(shortCode string) error {
+	purged, err := u.purge(shortCode, nil)
+	if err != nil {
+		return err
+	}
+	if !purged {
+		// Another purge removed it meanwhile
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// purge removes an item like Purge. With deletedBefore, only an item still
+// deleted before it is removed, the check is part of the delete so an item
+// restored meanwhile is kept. It reports whether the item was removed.
+func (u *UrlModel) purge(shortCode string, deletedBefore *time.Time) (bool, error) {
+	item, err := u.Get(shortCode, "")
+	if err != nil {
+		return false, err
+	}
+
+	ctx := context.Background()
+	if err := u.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("`key` = ?", item.Key)
+		if deletedBefore != nil {
+			query = query.Where("state = ? AND deleted_at < ?", StateDeleted, *deletedBefore)
+		}
+
+		result := query.Delete(&Url{})
+		if result.Error != nil {
+			return errors.Wrap(result.Error, "tx.Delete")
+		}
+		if result.RowsAffected == 0 {
+			return errNotPurged
+		}
+
+		for _, model := range []interface{}{&ClickEvent{}, &ClickRollup{}, &ClickDimensionRollup{}, &UrlRevision{}} {
+			// Click tables are created by the click writer
+			if !tx.Migrator().HasTable(model) {
+				continue
+			}
+
+			if result := tx.Where("code = ?", item.Key).Delete(model); result.Error != nil {
+				return errors.Wrap(result.Error, "tx.Delete")
+			}
+		}
+
+		if viper.GetBool(keyPurgeTombstone) {
+			tombstone := &Tombstone{Code: item.Key, CodeFold: strings.ToLower(item.Key)}
+			if result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(tombstone); result.Error != nil {
+				return errors.Wrap(result.Error, "tx.Create")
+			}
+		}
+
+		if err := u.redis.Del(ctx, item.GetCacheKey()).Err(); err != nil {
+			return errors.Wrap(err, "u.redis.Del")
+		}
+
+		return nil
+	}); err != nil {
+		if errors.Is(err, errNotPurged) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if err := u.purgeCounters(ctx, item.Key); err != nil {
+		u.log.With(zap.Error(err), zap.String("code", item.Key)).Error("u.purgeCounters")
+	}
+
+	return true, nil
+}
+
+// purgeCounters removes the redis keys of a code, including the cache entry
+// a reader may have written back during the purge
+func (u *UrlModel) purgeCounters(ctx context.Context, code string) error {
+	keys := []string{
+		Url{Key: code}.GetCacheKey(),
+		pendingHitsKey(code),
+		inflightHitsKey(code),
+		visitorsKey(code),
+		passwordFailuresKey(code),
+		QrCacheKey(code),
+	}
+
+	now := time.Now()
+	for day := 0; day <= viper.GetInt(keyVisitorsRetentionDays); day++ {
+		keys = append(keys, dailyVisitorsKey(code, now.AddDate(0, 0, -day)))
+	}
+
+	if _, err := u.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.SRem(ctx, hitsPendingSet, code)
+		pipe.SRem(ctx, hitsInflightSet, code)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "u.redis.TxPipelined")
+	}
+
+	return nil
+}
+
+// isTombstoned reports whether a code was used by a purged item, whatever
+// its case
+func (u *UrlModel) isTombstoned(code string) (bool, error) {
+	var count int64
+	if result := u.db.Model(&Tombstone{}).Where("code_fold = ?", strings.ToLower(code)).Count(&count); result.Error != nil {
+		return false, errors.Wrap(result.Error, "u.db.Count")
+	}
+
+	return count != 0, nil
+}
+
+// RetentionPurger purges the items deleted for longer than the retention
+type RetentionPurger struct {
+	model    *UrlModel
+	log      *zap.Logger
+	interval time.Duration
+}
+
+func NewRetentionPurger(log *zap.Logger, redis *redis.Client, db *gorm.DB) (*RetentionPurger, error) {
+	model, err := NewUrlModel(log, redis, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewUrlModel")
+	}
+
+	return &RetentionPurger{
+		model:    model,
+		log:      log,
+		interval: viper.GetDuration(keyPurgeInterval),
+	}, nil
+}
+
+// Run purges the items periodically until the context is done
+func (p *RetentionPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.Purge(ctx, time.Now()); err != nil {
+				p.log.With(zap.Error(err)).Error("p.Purge")
+			}
+		}
+	}
+}
+
+// Purge removes every item deleted before the retention, returning their
+// number
+func (p *RetentionPurger) Purge(ctx context.Context, now time.Time) (int, error) {
+	days := viper.GetInt(keyPurgeRetentionDays)
+	if days <= 0 {
+		return 0, nil
+	}
+
+	token, err := acquireLock(ctx, p.model.redis, purgeLock, p.interval)
+	if err != nil {
+		return 0, err
+	}
+	if len(token) == 0 {
+		// Another instance is purging
+		return 0, nil
+	}
+	defer func() {
+		if err := releaseLock(context.Background(), p.model.redis, purgeLock, token); err != nil {
+			p.log.With(zap.Error(err)).Error("releaseLock")
+		}
+	}()
+
+	before := now.AddDate(0, 0, -days)
+	purged := 0
+	for {
+		var codes []string
+		if result := p.model.db.WithContext(ctx).Model(&Url{}).
+			Where("state = ? AND deleted_at < ?", StateDeleted, before).
+			Order("id").Limit(purgeBatchSize).Pluck("key", &codes); result.Error != nil {
+			return purged, errors.Wrap(result.Error, "db.Pluck")
+		}
+
+		if len(codes) == 0 {
+			return purged, nil
+		}
+
+		// Keep the lock for the next batch, the run stops once another
+		// instance took it over
+		held, err := extendLock(ctx, p.model.redis, purgeLock, token, p.interval)
+		if err != nil {
+			return purged, err
+		}
+		if !held {
+			p.log.Warn("Purge lock lost, stopping")
+			return purged, nil
+		}
+
+		for _, code := range codes {
+			// Items purged or restored meanwhile are skipped
+			ok, err := p.model.purge(code, &before)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				return purged, errors.Wrap(err, "p.model.purge")
+			}
+			if ok {
+				purged++
+			}
+		}
+
+		p.log.With(zap.Int("purged", purged)).Info("Deleted urls purged")
+	}
+}
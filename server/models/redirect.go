@@ -0,0 +1,112 @@
+package models
+
+import (
+	"net/url"
+)
+
+// Redirect types of the items, an empty type is a temporary redirect
+const (
+	RedirectPermanent         = "301"
+	RedirectFound             = "302"
+	RedirectTemporary         = "307"
+	RedirectPermanentRedirect = "308"
+	// RedirectMeta and RedirectJS answer with a page sending the browser on
+	RedirectMeta = "meta"
+	RedirectJS   = "js"
+)
+
+// Query passthrough modes, an empty mode drops the incoming query
+const (
+	PassthroughNone = "none"
+	// PassthroughPreserve adds the incoming parameters missing from the destination
+	PassthroughPreserve = "preserve"
+	// PassthroughOverride lets the incoming parameters replace those of the destination
+	PassthroughOverride = "override"
+)
+
+// UtmParams are the campaign parameters added to the destination of an item
+type UtmParams struct {
+	Source   string `gorm:"size:255;not null;default:''" json:"source,omitempty"`
+	Medium   string `gorm:"size:255;not null;default:''" json:"medium,omitempty"`
+	Campaign string `gorm:"size:255;not null;default:''" json:"campaign,omitempty"`
+	Term     string `gorm:"size:255;not null;default:''" json:"term,omitempty"`
+	Content  string `gorm:"size:255;not null;default:''" json:"content,omitempty"`
+}
+
+func (p UtmParams) values() url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"utm_source":   p.Source,
+		"utm_medium":   p.Medium,
+		"utm_campaign": p.Campaign,
+		"utm_term":     p.Term,
+		"utm_content":  p.Content,
+	} {
+		if len(value) != 0 {
+			values.Set(name, value)
+		}
+	}
+
+	return values
+}
+
+// Destination builds the url a visitor is redirected to. UTM parameters are
+// only added when the origin lacks them, the incoming query is then merged
+// by the passthrough mode of the item.
+func (u Url) Destination(incoming url.Values) string {
+	return u.destinationOf(u.Origin, incoming)
+}
+
+// destinationOf applies the UTM parameters and the passthrough mode of the
+// item to a target, the origin or the target of a rule
+func (u Url) destinationOf(target string, incoming url.Values) string {
+	utm := u.Utm.values()
+	passthrough := u.QueryPassthrough == PassthroughPreserve || u.QueryPassthrough == PassthroughOverride
+	if len(utm) == 0 && (!passthrough || len(incoming) == 0) {
+		return target
+	}
+
+	destination, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	query := destination.Query()
+	merge := func(values url.Values, override bool) {
+		for name, value := range values {
+			if _, ok := query[name]; ok && !override {
+				continue
+			}
+			query[name] = value
+		}
+	}
+
+	merge(utm, false)
+	if passthrough {
+		merge(incoming, u.QueryPassthrough == PassthroughOverride)
+	}
+
+	destination.RawQuery = query.Encode()
+	return destination.String()
+}
+
+// routingTargets lists the targets of the rules and variants of an item, and
+// the fallbacks of its deep link
+func routingTargets(rules RedirectRules, variants Variants, deepLink DeepLink) []string {
+	var targets []string
+	for _, rule := range rules {
+		targets = append(targets, rule.Target)
+	}
+
+	for _, variant := range variants {
+		targets = append(targets, variant.Target)
+	}
+
+	for _, target := range []string{deepLink.IosStore, deepLink.AndroidStore, deepLink.Web} {
+		if len(target) != 0 {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Reasons recorded by the changes made without one
+const (
+	ReasonCreate  = "create"
+	ReasonUpdate  = "update"
+	ReasonDelete  = "delete"
+	ReasonRestore = "restore"
+)
+
+// UrlRevision is the state of an item after one of its changes. Revisions
+// are numbered by the version of the item.
+type UrlRevision struct {
+	ID           uint       `gorm:"primaryKey;autoIncrement" json:"-"`
+	Code         string     `gorm:"size:64;not null;uniqueIndex:idx_url_revisions_code_revision" json:"-"`
+	Revision     uint       `gorm:"not null;uniqueIndex:idx_url_revisions_code_revision" json:"revision"`
+	Origin       string     `gorm:"not null" json:"origin_url"`
+	Expiry       *time.Time `json:"expiry"`
+	ActiveFrom   *time.Time `json:"active_from,omitempty"`
+	PrelaunchUrl string     `json:"prelaunch_url,omitempty"`
+	// The routing and display settings editable along the destination
+	RedirectType     string        `gorm:"size:8;not null;default:''" json:"redirect_type,omitempty"`
+	QueryPassthrough string        `gorm:"size:16;not null;default:''" json:"query_passthrough,omitempty"`
+	Utm              UtmParams     `gorm:"embedded;embeddedPrefix:utm_" json:"utm"`
+	Rules            RedirectRules `gorm:"type:text" json:"rules,omitempty"`
+	Variants         Variants      `gorm:"type:text" json:"variants,omitempty"`
+	SplitMode        string        `gorm:"size:8;not null;default:''" json:"split_mode,omitempty"`
+	DeepLink         DeepLink      `gorm:"embedded;embeddedPrefix:deeplink_" json:"deep_link"`
+	Title            string        `gorm:"size:255;not null;default:''" json:"title,omitempty"`
+	Interstitial     bool          `gorm:"not null;default:false" json:"interstitial"`
+	Status           bool          `json:"status"`
+	State            LinkState     `gorm:"size:16" json:"state"`
+	Actor            string        `gorm:"size:64" json:"actor"`
+	Reason           string        `gorm:"size:255" json:"reason"`
+	CreatedAt        time.Time     `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func newRevision(item Url, actor, reason string) *UrlRevision {
+	if len(reason) == 0 {
+		reason = ReasonUpdate
+	}
+
+	return &UrlRevision{
+		Code:             item.Key,
+		Revision:         item.Version,
+		Origin:           item.Origin,
+		Expiry:           item.Expiry,
+		ActiveFrom:       item.ActiveFrom,
+		PrelaunchUrl:     item.PrelaunchUrl,
+		RedirectType:     item.RedirectType,
+		QueryPassthrough: item.QueryPassthrough,
+		Utm:              item.Utm,
+		Rules:            item.Rules,
+		Variants:         item.Variants,
+		SplitMode:        item.SplitMode,
+		DeepLink:         item.DeepLink,
+		Title:            item.Title,
+		Interstitial:     item.Interstitial,
+		Status:           item.Status,
+		State:            item.State,
+		Actor:            actor,
+		Reason:           reason,
+	}
+}
+
+// History lists the revisions of an item, latest first
+func (u *UrlModel) History(shortCode string) ([]UrlRevision, error) {
+	var revisions []UrlRevision
+	if result := u.db.Where("code = ?", shortCode).Order("revision DESC").Find(&revisions); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "u.db.Find")
+	}
+
+	return revisions, nil
+}
+
+// Rollback restores the destination, times, routing settings and state of a
+// revision. It is an update like the others, recorded as a new revision, the
+// state has to be reachable from the current one.
+func (u *UrlModel) Rollback(shortCode string, revision, version uint, actor, reason string) (*Url, error) {
+	rev := &UrlRevision{}
+	if result := u.db.Where("code = ? AND revision = ?", shortCode, revision).First(rev); result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+
+		return nil, errors.Wrap(result.Error, "u.db.First")
+	}
+
+	if len(reason) == 0 {
+		reason = "rollback to revision " + strconv.FormatUint(uint64(revision), 10)
+	}
+
+	// Revisions recorded before states existed only have a status
+	state := rev.State
+	if len(state) == 0 {
+		state = Url{Status: rev.Status}.stateOf()
+	}
+
+	// Times missing from the revision are cleared
+	expire, activeFrom := time.Time{}, time.Time{}
+	if rev.Expiry != nil {
+		expire = *rev.Expiry
+	}
+	if rev.ActiveFrom != nil {
+		activeFrom = *rev.ActiveFrom
+	}
+
+	return u.Update(shortCode, "", version, UrlChanges{
+		Origin:           &rev.Origin,
+		Expire:           &expire,
+		ActiveFrom:       &activeFrom,
+		PrelaunchUrl:     &rev.PrelaunchUrl,
+		RedirectType:     &rev.RedirectType,
+		QueryPassthrough: &rev.QueryPassthrough,
+		Utm:              &rev.Utm,
+		Rules:            &rev.Rules,
+		Variants:         &rev.Variants,
+		SplitMode:        &rev.SplitMode,
+		DeepLink:         &rev.DeepLink,
+		Title:            &rev.Title,
+		Interstitial:     &rev.Interstitial,
+		State:            &state,
+		Actor:            actor,
+		Reason:           reason,
+	})
+}
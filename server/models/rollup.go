@@ -0,0 +1,354 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+)
+
+// Stats intervals
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+)
+
+// Dimensions of the click rollups
+const (
+	DimensionReferrer = "referrer"
+	DimensionCountry  = "country"
+	DimensionDevice   = "device"
+	DimensionBrowser  = "browser"
+	// DimensionRule counts the clicks matching a redirect rule only
+	DimensionRule = "rule"
+	// DimensionVariant counts the clicks of each variant of a split only
+	DimensionVariant = "variant"
+	// DimensionSource counts the clicks of each marked short url only
+	DimensionSource = "source"
+)
+
+// Number of values returned by dimension
+const topValues = 10
+
+// Size of the dimension values, the referrer hosts are clipped to it
+const maxDimensionValueLength = 191
+
+// ClickRollup counts the human and bot clicks of a code by hour
+type ClickRollup struct {
+	Code   string    `gorm:"primaryKey;size:191"`
+	Bucket time.Time `gorm:"primaryKey"`
+	Clicks uint64    `gorm:"not null;default:0"`
+	Bots   uint64    `gorm:"not null;default:0"`
+}
+
+// ClickDimensionRollup counts the human clicks of a code by day and dimension value
+type ClickDimensionRollup struct {
+	Code      string    `gorm:"primaryKey;size:191"`
+	Day       time.Time `gorm:"primaryKey"`
+	Dimension string    `gorm:"primaryKey;size:16"`
+	Value     string    `gorm:"primaryKey;size:191"`
+	Clicks    uint64    `gorm:"not null;default:0"`
+}
+
+// StatsPoint is a bucket of the click time series, unique visitors are only
+// counted by day
+type StatsPoint struct {
+	Time           time.Time `json:"time"`
+	Clicks         uint64    `json:"clicks"`
+	BotClicks      uint64    `json:"bot_clicks"`
+	UniqueVisitors *uint64   `json:"unique_visitors,omitempty"`
+}
+
+// StatsValue is a value of a dimension with its clicks
+type StatsValue struct {
+	Value  string `json:"value"`
+	Clicks uint64 `json:"clicks"`
+}
+
+// Stats describes the clicks of a code over a period. Series buckets cover
+// the period exactly, while dimensions count the whole days it overlaps.
+// Bot clicks are only counted apart, and unique visitors are counted over the
+// days of the period, the last 7 days and ever.
+type Stats struct {
+	Code                   string       `json:"code"`
+	From                   time.Time    `json:"from"`
+	To                     time.Time    `json:"to"`
+	Interval               string       `json:"interval"`
+	Clicks                 uint64       `json:"clicks"`
+	BotClicks              uint64       `json:"bot_clicks"`
+	UniqueVisitors         uint64       `json:"unique_visitors"`
+	WeeklyUniqueVisitors   uint64       `json:"weekly_unique_visitors"`
+	LifetimeUniqueVisitors uint64       `json:"lifetime_unique_visitors"`
+	Series                 []StatsPoint `json:"series"`
+	Referrers              []StatsValue `json:"referrers"`
+	Countries              []StatsValue `json:"countries"`
+	Devices                []StatsValue `json:"devices"`
+	Browsers               []StatsValue `json:"browsers"`
+	Rules                  []StatsValue `json:"rules"`
+	Variants               []StatsValue `json:"variants"`
+	Sources                []StatsValue `json:"sources"`
+}
+
+// rollupClicks adds a batch of events to the rollup tables
+func rollupClicks(tx *gorm.DB, events []ClickEvent) error {
+	hours := map[ClickRollup]*ClickRollup{}
+	dimensions := map[ClickDimensionRollup]uint64{}
+	for _, event := range events {
+		key := ClickRollup{Code: event.Code, Bucket: truncate(event.CreatedAt, IntervalHour)}
+		hour, ok := hours[key]
+		if !ok {
+			hour = &ClickRollup{Code: key.Code, Bucket: key.Bucket}
+			hours[key] = hour
+		}
+
+		if event.Bot {
+			hour.Bots++
+			continue
+		}
+		hour.Clicks++
+
+		day := truncate(event.CreatedAt, IntervalDay)
+		for dimension, value := range map[string]string{
+			DimensionReferrer: libs.Clip(referrerHost(event.Referrer), maxDimensionValueLength),
+			DimensionCountry:  event.Country,
+			DimensionDevice:   event.Device,
+			DimensionBrowser:  event.Browser,
+		} {
+			dimensions[ClickDimensionRollup{Code: event.Code, Day: day, Dimension: dimension, Value: value}]++
+		}
+		if len(event.Rule) != 0 {
+			dimensions[ClickDimensionRollup{Code: event.Code, Day: day, Dimension: DimensionRule, Value: event.Rule}]++
+		}
+		if len(event.Variant) != 0 {
+			dimensions[ClickDimensionRollup{Code: event.Code, Day: day, Dimension: DimensionVariant, Value: event.Variant}]++
+		}
+		if len(event.Source) != 0 {
+			dimensions[ClickDimensionRollup{Code: event.Code, Day: day, Dimension: DimensionSource, Value: event.Source}]++
+		}
+	}
+
+	hourRows := make([]ClickRollup, 0, len(hours))
+	for _, row := range hours {
+		hourRows = append(hourRows, *row)
+	}
+	if err := tx.Clauses(incrementOnConflict(tx, []string{"clicks", "bots"}, "code", "bucket")).
+		Create(&hourRows).Error; err != nil {
+		return errors.Wrap(err, "tx.Create")
+	}
+
+	// Batches of bot clicks have no dimension
+	if len(dimensions) == 0 {
+		return nil
+	}
+
+	dimensionRows := make([]ClickDimensionRollup, 0, len(dimensions))
+	for row, clicks := range dimensions {
+		row.Clicks = clicks
+		dimensionRows = append(dimensionRows, row)
+	}
+	if err := tx.Clauses(incrementOnConflict(tx, []string{"clicks"}, "code", "day", "dimension", "value")).
+		Create(&dimensionRows).Error; err != nil {
+		return errors.Wrap(err, "tx.Create")
+	}
+
+	return nil
+}
+
+// incrementOnConflict adds the inserted values of the columns to the existing
+// row with the same keys
+func incrementOnConflict(db *gorm.DB, columns []string, keys ...string) clause.OnConflict {
+	conflict := clause.OnConflict{}
+	for _, key := range keys {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: key})
+	}
+
+	assignments := map[string]interface{}{}
+	for _, column := range columns {
+		inserted := "excluded." + column
+		if db.Dialector.Name() == "mysql" {
+			inserted = "VALUES(" + column + ")"
+		}
+		assignments[column] = gorm.Expr(column + " + " + inserted)
+	}
+	conflict.DoUpdates = clause.Assignments(assignments)
+
+	return conflict
+}
+
+// referrerHost keeps the host of a referrer, so the values stay few
+func referrerHost(referrer string) string {
+	if len(referrer) == 0 {
+		return ""
+	}
+
+	parsed, err := url.Parse(referrer)
+	if err != nil || len(parsed.Host) == 0 {
+		return ""
+	}
+
+	return parsed.Hostname()
+}
+
+// truncate returns the start of the utc bucket of a time
+func truncate(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	if interval == IntervalDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return t.Truncate(time.Hour)
+}
+
+// StatsModel reads the click rollups and the unique visitors
+type StatsModel struct {
+	redis *redis.Client
+	db    *gorm.DB
+	log   *zap.Logger
+}
+
+// Stats returns the clicks of a code between from (included) and to (excluded)
+func (s *StatsModel) Stats(code string, from, to time.Time, interval string) (*Stats, error) {
+	if interval != IntervalHour && interval != IntervalDay {
+		return nil, errors.Errorf("unknown interval %q", interval)
+	}
+
+	stats := &Stats{
+		Code:     code,
+		From:     truncate(from, interval),
+		To:       to.UTC(),
+		Interval: interval,
+	}
+
+	var rows []ClickRollup
+	if err := s.db.Where("code = ? AND bucket >= ? AND bucket < ?", code, stats.From, stats.To).
+		Order("bucket").Find(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "db.Find")
+	}
+
+	clicks := map[time.Time]*StatsPoint{}
+	for _, row := range rows {
+		bucket := truncate(row.Bucket, interval)
+		point, ok := clicks[bucket]
+		if !ok {
+			point = &StatsPoint{Time: bucket}
+			clicks[bucket] = point
+		}
+		point.Clicks += row.Clicks
+		point.BotClicks += row.Bots
+		stats.Clicks += row.Clicks
+		stats.BotClicks += row.Bots
+	}
+
+	for bucket := stats.From; bucket.Before(stats.To); bucket = next(bucket, interval) {
+		if point, ok := clicks[bucket]; ok {
+			stats.Series = append(stats.Series, *point)
+			continue
+		}
+		stats.Series = append(stats.Series, StatsPoint{Time: bucket})
+	}
+
+	if err := s.visitors(stats); err != nil {
+		return nil, err
+	}
+
+	for dimension, values := range map[string]*[]StatsValue{
+		DimensionReferrer: &stats.Referrers,
+		DimensionCountry:  &stats.Countries,
+		DimensionDevice:   &stats.Devices,
+		DimensionBrowser:  &stats.Browsers,
+		DimensionRule:     &stats.Rules,
+		DimensionVariant:  &stats.Variants,
+		DimensionSource:   &stats.Sources,
+	} {
+		top, err := s.top(code, dimension, truncate(from, IntervalDay), stats.To)
+		if err != nil {
+			return nil, err
+		}
+		*values = top
+	}
+
+	return stats, nil
+}
+
+// top returns the values of a dimension with the most clicks
+func (s *StatsModel) top(code, dimension string, from, to time.Time) ([]StatsValue, error) {
+	values := []StatsValue{}
+	if err := s.db.Model(&ClickDimensionRollup{}).
+		Select("value, SUM(clicks) AS clicks").
+		Where("code = ? AND dimension = ? AND day >= ? AND day < ?", code, dimension, from, to).
+		Group("value").
+		Order("clicks DESC, value").
+		Limit(topValues).
+		Scan(&values).Error; err != nil {
+		return nil, errors.Wrap(err, "db.Scan")
+	}
+
+	return values, nil
+}
+
+// visitors counts the unique visitors of the stats
+func (s *StatsModel) visitors(stats *Stats) error {
+	ctx := context.Background()
+	if stats.Interval == IntervalDay {
+		// Daily counts are read at once
+		counts := make([]*redis.IntCmd, len(stats.Series))
+		if _, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, point := range stats.Series {
+				counts[i] = pipe.PFCount(ctx, dailyVisitorsKey(stats.Code, point.Time))
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "s.redis.Pipelined")
+		}
+
+		for i, count := range counts {
+			visitors := uint64(count.Val())
+			stats.Series[i].UniqueVisitors = &visitors
+		}
+	}
+
+	var err error
+	if stats.UniqueVisitors, err = uniqueVisitors(ctx, s.redis, stats.Code, stats.From, stats.To); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if stats.WeeklyUniqueVisitors, err = uniqueVisitors(ctx, s.redis, stats.Code, now.AddDate(0, 0, -6), now); err != nil {
+		return err
+	}
+
+	lifetime, err := s.redis.PFCount(ctx, visitorsKey(stats.Code)).Result()
+	if err != nil {
+		return errors.Wrap(err, "s.redis.PFCount")
+	}
+	stats.LifetimeUniqueVisitors = uint64(lifetime)
+
+	return nil
+}
+
+func next(bucket time.Time, interval string) time.Time {
+	if interval == IntervalDay {
+		return bucket.AddDate(0, 0, 1)
+	}
+
+	return bucket.Add(time.Hour)
+}
+
+func NewStatsModel(log *zap.Logger, redis *redis.Client, db *gorm.DB) (*StatsModel, error) {
+	if err := db.AutoMigrate(&ClickRollup{}, &ClickDimensionRollup{}); err != nil {
+		return nil, errors.Wrap(err, "db.AutoMigrate")
+	}
+
+	return &StatsModel{
+		redis: redis,
+		db:    db,
+		log:   log,
+	}, nil
+}
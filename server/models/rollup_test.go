@@ -0,0 +1,140 @@
+package models
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/danielnguyentb/url-shortener/libs"
+)
+
+func TestStats(t *testing.T) {
+	log := libs.InitLogging()
+
+	db, err := gorm.Open(sqlite.Open("rollup_test.db"))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.Remove("rollup_test.db"))
+	}()
+
+	writer, err := NewClickWriter(log, db)
+	require.NoError(t, err)
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	stats, err := NewStatsModel(log, client, db)
+	require.NoError(t, err)
+
+	day := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	click := func(at time.Time, referrer, country, device string) ClickEvent {
+		return ClickEvent{Code: "abc", CreatedAt: at, Referrer: referrer, Country: country, Device: device, Browser: "Chrome"}
+	}
+
+	log.Debug("Batches are added to the rollups of existing buckets")
+	split := click(day.Add(26*time.Hour), "", "US", DeviceDesktop)
+	split.Variant = "b"
+	split.Source = "qr"
+	require.NoError(t, writer.store([]ClickEvent{
+		click(day.Add(9*time.Hour), "https://t.co/x", "VN", DeviceMobile),
+		click(day.Add(9*time.Hour+30*time.Minute), "https://t.co/y", "VN", DeviceMobile),
+		split,
+	}))
+	require.NoError(t, writer.store([]ClickEvent{
+		{Code: "abc", CreatedAt: day.Add(9*time.Hour + 45*time.Minute), Referrer: "https://news.example.com/a", Country: "US", Device: DeviceDesktop, Browser: "Chrome", Rule: "ios"},
+		{Code: "other", CreatedAt: day.Add(9 * time.Hour)},
+	}))
+
+	log.Debug("Bot clicks are only counted apart")
+	require.NoError(t, writer.store([]ClickEvent{
+		{Code: "abc", CreatedAt: day.Add(9 * time.Hour), Browser: "Slackbot", Bot: true, BotReason: "user-agent"},
+	}))
+
+	var rollup ClickRollup
+	require.NoError(t, db.Where("code = ?", "abc").Order("bucket").First(&rollup).Error)
+	assert.Equal(t, uint64(3), rollup.Clicks)
+
+	log.Debug("Daily series covers every day of the period")
+	result, err := stats.Stats("abc", day, day.AddDate(0, 0, 3), IntervalDay)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), result.Clicks)
+	assert.Equal(t, uint64(1), result.BotClicks)
+	assert.Equal(t, uint64(1), result.Series[0].BotClicks)
+	require.Len(t, result.Series, 3)
+	assert.Equal(t, uint64(3), result.Series[0].Clicks)
+	assert.Equal(t, uint64(1), result.Series[1].Clicks)
+	assert.Equal(t, uint64(0), result.Series[2].Clicks)
+	assert.Equal(t, []StatsValue{{Value: "t.co", Clicks: 2}, {Value: "", Clicks: 1}, {Value: "news.example.com", Clicks: 1}}, result.Referrers)
+	assert.Equal(t, []StatsValue{{Value: "US", Clicks: 2}, {Value: "VN", Clicks: 2}}, result.Countries)
+	assert.Equal(t, []StatsValue{{Value: "Chrome", Clicks: 4}}, result.Browsers)
+	assert.Equal(t, []StatsValue{{Value: "ios", Clicks: 1}}, result.Rules)
+	assert.Equal(t, []StatsValue{{Value: "b", Clicks: 1}}, result.Variants)
+	assert.Equal(t, []StatsValue{{Value: "qr", Clicks: 1}}, result.Sources)
+
+	log.Debug("Hourly series")
+	result, err = stats.Stats("abc", day.Add(8*time.Hour), day.Add(11*time.Hour), IntervalHour)
+	require.NoError(t, err)
+	require.Len(t, result.Series, 3)
+	assert.Equal(t, day.Add(9*time.Hour), result.Series[1].Time)
+	assert.Equal(t, uint64(3), result.Series[1].Clicks)
+	assert.Equal(t, uint64(3), result.Clicks)
+	assert.Nil(t, result.Series[1].UniqueVisitors)
+
+	log.Debug("Unique visitors are counted once per fingerprint")
+	model, err := NewUrlModel(log, client, db)
+	require.NoError(t, err)
+	require.NoError(t, model.CountVisitor("abc", "203.0.113.42", "Chrome"))
+	require.NoError(t, model.CountVisitor("abc", "203.0.113.42", "Chrome"))
+	require.NoError(t, model.CountVisitor("abc", "203.0.113.42", "Firefox"))
+	require.NoError(t, model.CountVisitor("abc", "198.51.100.7", "Chrome"))
+	require.NoError(t, model.CountVisitor("other", "198.51.100.7", "Chrome"))
+
+	now := time.Now()
+	result, err = stats.Stats("abc", now.AddDate(0, 0, -1), now, IntervalDay)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), result.UniqueVisitors)
+	assert.Equal(t, uint64(3), result.WeeklyUniqueVisitors)
+	assert.Equal(t, uint64(3), result.LifetimeUniqueVisitors)
+	require.Len(t, result.Series, 2)
+	require.NotNil(t, result.Series[1].UniqueVisitors)
+	assert.Equal(t, uint64(0), *result.Series[0].UniqueVisitors)
+	assert.Equal(t, uint64(3), *result.Series[1].UniqueVisitors)
+
+	log.Debug("Visitors coming back another day are counted once over the period")
+	yesterday := time.Now().AddDate(0, 0, -1)
+	require.NoError(t, model.countVisitor("span", "203.0.113.42", "Chrome", yesterday))
+	require.NoError(t, model.countVisitor("span", "198.51.100.7", "Chrome", yesterday))
+	require.NoError(t, model.CountVisitor("span", "203.0.113.42", "Chrome"))
+	result, err = stats.Stats("span", now.AddDate(0, 0, -1), now, IntervalDay)
+	require.NoError(t, err)
+	// miniredis adds up the counts of several daily keys where redis merges
+	// them, the lifetime set spans both days
+	assert.Equal(t, uint64(2), result.LifetimeUniqueVisitors)
+	require.Len(t, result.Series, 2)
+	assert.Equal(t, uint64(2), *result.Series[0].UniqueVisitors)
+	assert.Equal(t, uint64(1), *result.Series[1].UniqueVisitors)
+
+	log.Debug("Long referrer hosts are clipped to the dimension values")
+	host := strings.Repeat("a", 250) + ".example.com"
+	require.NoError(t, writer.store([]ClickEvent{
+		{Code: "long", CreatedAt: day, Referrer: "https://" + host + "/path", Browser: "Chrome"},
+	}))
+	result, err = stats.Stats("long", day, day.AddDate(0, 0, 1), IntervalDay)
+	require.NoError(t, err)
+	assert.Equal(t, []StatsValue{{Value: host[:maxDimensionValueLength], Clicks: 1}}, result.Referrers)
+
+	log.Debug("Ip addresses are never stored")
+	assert.NotContains(t, mr.Dump(), "203.0.113.42")
+}
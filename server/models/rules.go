@@ -0,0 +1,250 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxRules bounds the rules of an item, they are evaluated on every redirect
+const maxRules = 32
+
+var (
+	ErrInvalidRule = errors.New("Invalid Redirect Rule")
+)
+
+// RedirectRule sends the visitors matching every condition to its target.
+// Empty conditions match every visitor, a rule without conditions is a
+// catch-all.
+type RedirectRule struct {
+	// Name is recorded with the clicks matching the rule
+	Name string `json:"name,omitempty"`
+	// Countries are iso country codes located from the ip of the visitor
+	Countries []string `json:"countries,omitempty"`
+	// OS are operating system names from the user agent, like iOS or Android
+	OS []string `json:"os,omitempty"`
+	// Devices are device types of the clicks: mobile, desktop or bot
+	Devices []string `json:"devices,omitempty"`
+	// Languages match the preferred language of the visitor, de matches de-AT
+	Languages []string `json:"languages,omitempty"`
+	// Referrers are domains matching the referrer host and its subdomains
+	Referrers []string   `json:"referrers,omitempty"`
+	After     *time.Time `json:"after,omitempty"`
+	Before    *time.Time `json:"before,omitempty"`
+	Target    string     `json:"target"`
+}
+
+// RedirectRules are the ordered rules of an item, stored as json
+type RedirectRules []RedirectRule
+
+// Visitor describes the request of a redirect for the rules
+type Visitor struct {
+	Country string
+	OS      string
+	Device  string
+	// AcceptLanguage is the Accept-Language header of the request
+	AcceptLanguage string
+	Referrer       string
+	Time           time.Time
+	// Key identifies the visitor for the hashed splits
+	Key string
+	// Variant is the label of the variant assigned by a previous redirect
+	Variant string
+}
+
+// Value stores the rules as json, no rules as NULL
+func (rules RedirectRules) Value() (driver.Value, error) {
+	return jsonValue(rules, len(rules) == 0)
+}
+
+// Scan reads the rules stored as json
+func (rules *RedirectRules) Scan(value interface{}) error {
+	*rules = nil
+	return scanJSON(value, rules)
+}
+
+// Label returns the name of a rule recorded with the clicks, its position
+// when it has no name
+func (r RedirectRule) Label(position int) string {
+	if len(r.Name) != 0 {
+		return r.Name
+	}
+
+	return fmt.Sprintf("#%d", position+1)
+}
+
+// Matches reports whether a visitor meets every condition of the rule
+func (r RedirectRule) Matches(v Visitor) bool {
+	if r.After != nil && v.Time.Before(*r.After) {
+		return false
+	}
+
+	if r.Before != nil && !v.Time.Before(*r.Before) {
+		return false
+	}
+
+	if len(r.Countries) != 0 && !containsFold(r.Countries, v.Country) {
+		return false
+	}
+
+	if len(r.OS) != 0 && !containsFold(r.OS, v.OS) {
+		return false
+	}
+
+	if len(r.Devices) != 0 && !containsFold(r.Devices, v.Device) {
+		return false
+	}
+
+	if len(r.Languages) != 0 && !matchLanguage(r.Languages, preferredLanguage(v.AcceptLanguage)) {
+		return false
+	}
+
+	if len(r.Referrers) != 0 && !MatchDomain(r.Referrers, strings.ToLower(referrerHost(v.Referrer))) {
+		return false
+	}
+
+	return true
+}
+
+// Routing is the outcome of routing a visitor through an item
+type Routing struct {
+	Destination string
+	// Rule and Variant are the labels of the rule or the variant chosen
+	Rule    string
+	Variant string
+}
+
+// Route sends a visitor to the target of the first matching rule, then to a
+// variant of the split, then to the origin
+func (u Url) Route(v Visitor, incoming url.Values) (Routing, error) {
+	for i, rule := range u.Rules {
+		if rule.Matches(v) {
+			return Routing{Destination: u.destinationOf(rule.Target, incoming), Rule: rule.Label(i)}, nil
+		}
+	}
+
+	if len(u.Variants) != 0 {
+		i, err := u.chooseVariant(v)
+		if err != nil {
+			return Routing{}, err
+		}
+
+		variant := u.Variants[i]
+		return Routing{Destination: u.destinationOf(variant.Target, incoming), Variant: variant.Label(i)}, nil
+	}
+
+	return Routing{Destination: u.Destination(incoming)}, nil
+}
+
+// validateRules checks the number and the times of the rules of an item
+func validateRules(rules RedirectRules) error {
+	if len(rules) > maxRules {
+		return errors.Wrapf(ErrInvalidRule, "more than %d rules", maxRules)
+	}
+
+	for i, rule := range rules {
+		if len(rule.Target) == 0 {
+			return errors.Wrapf(ErrInvalidRule, "rule %s has no target", rule.Label(i))
+		}
+
+		if rule.After != nil && rule.Before != nil && !rule.After.Before(*rule.Before) {
+			return errors.Wrapf(ErrInvalidRule, "rule %s ends before it starts", rule.Label(i))
+		}
+	}
+
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchLanguage matches a language tag against rule languages, a primary
+// language matches its regional variants
+func matchLanguage(languages []string, tag string) bool {
+	if len(tag) == 0 {
+		return false
+	}
+
+	for _, language := range languages {
+		if strings.EqualFold(language, tag) || strings.HasPrefix(strings.ToLower(tag), strings.ToLower(language)+"-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preferredLanguage returns the language of highest quality of an
+// Accept-Language header, the first one on ties
+func preferredLanguage(header string) string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			languages = append(languages, weighted{tag: tag, quality: quality})
+		}
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	return languages[0].tag
+}
+
+// MatchDomain matches a host against domains and their subdomains
+func MatchDomain(domains []string, host string) bool {
+	if len(host) == 0 {
+		return false
+	}
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,297 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrVersionConflict = errors.New("Version Conflict")
+)
+
+// UrlChanges are the fields of an item to update, nil fields are left as
+// they are. A zero Expire or ActiveFrom clears it.
+type UrlChanges struct {
+	Origin       *string
+	Expire       *time.Time
+	ActiveFrom   *time.Time
+	PrelaunchUrl *string
+	State        *LinkState
+	// Status moves the item to the active or deleted state when no State is set
+	Status           *bool
+	RedirectType     *string
+	QueryPassthrough *string
+	// Utm replaces every UTM parameter of the item
+	Utm *UtmParams
+	// Rules replaces every rule of the item, an empty list removes them
+	Rules *RedirectRules
+	// Variants replaces every variant of the item, an empty list removes them
+	Variants  *Variants
+	SplitMode *string
+	// DeepLink replaces every deep link setting of the item
+	DeepLink     *DeepLink
+	Title        *string
+	Interstitial *bool
+	// Actor and Reason are recorded in the history of the item
+	Actor  string
+	Reason string
+}
+
+// Targets lists the destinations set by the changes, callers check them
+// against the blacklist
+func (c UrlChanges) Targets() []string {
+	var targets []string
+	if c.Origin != nil {
+		targets = append(targets, *c.Origin)
+	}
+
+	var rules RedirectRules
+	if c.Rules != nil {
+		rules = *c.Rules
+	}
+	var variants Variants
+	if c.Variants != nil {
+		variants = *c.Variants
+	}
+	var deepLink DeepLink
+	if c.DeepLink != nil {
+		deepLink = *c.DeepLink
+	}
+
+	return append(targets, routingTargets(rules, variants, deepLink)...)
+}
+
+// ETag is the entity tag of the item version
+func (u Url) ETag() string {
+	return strconv.Quote(strconv.FormatUint(uint64(u.Version), 10))
+}
+
+// setState moves the item to a moderation state, keeping its status and
+// deletion time along
+func (u *Url) setState(state LinkState, reason string) {
+	if state == StateDeleted && u.stateOf() != StateDeleted {
+		now := time.Now()
+		u.DeletedAt = &now
+	} else if state != StateDeleted {
+		u.DeletedAt = nil
+	}
+
+	u.State = state
+	u.StateReason = reason
+	u.Status = state == StateActive || state == StateFlagged
+}
+
+// validateSchedule checks the activation and expire times of an item
+func validateSchedule(expire, activeFrom *time.Time, prelaunchUrl string) error {
+	if activeFrom == nil {
+		if len(prelaunchUrl) != 0 {
+			return errors.New("prelaunch url needs an active from time")
+		}
+
+		return nil
+	}
+
+	if expire != nil && !activeFrom.Before(*expire) {
+		return errors.New("active from time must be before expire time")
+	}
+
+	return nil
+}
+
+// Get reads an item from the database, limited to the items of an owner
+// unless the owner is empty
+func (u *UrlModel) Get(shortCode, owner string) (*Url, error) {
+	query := u.db.Model(&Url{}).Where("`key` = ?", shortCode)
+	if len(owner) != 0 {
+		query = query.Where("owner = ?", owner)
+	}
+
+	item := &Url{}
+	if result := query.First(item); result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+
+		return nil, errors.Wrap(result.Error, "query.First")
+	}
+
+	return item, nil
+}
+
+// Update applies changes to an item of an owner, or any item with an empty
+// owner. A version other than 0 has to match the version of the item,
+// otherwise ErrVersionConflict is returned. The cache entry is rewritten
+// once the update is committed, a cache failure never undoes the update.
+func (u *UrlModel) Update(shortCode, owner string, version uint, changes UrlChanges) (*Url, error) {
+	item, err := u.Get(shortCode, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != 0 && item.Version != version {
+		return nil, ErrVersionConflict
+	}
+
+	updates := map[string]interface{}{}
+	if changes.Origin != nil {
+		item.Origin = *changes.Origin
+		item.OriginHash = HashOrigin(item.Origin)
+		updates["origin"] = item.Origin
+		updates["origin_hash"] = item.OriginHash
+	}
+
+	if changes.Expire != nil {
+		item.Expiry = nil
+		if !changes.Expire.IsZero() {
+			if time.Now().After(*changes.Expire) {
+				return nil, errors.New("expire time is invalid")
+			}
+			item.Expiry = changes.Expire
+		}
+		updates["expiry"] = item.Expiry
+	}
+
+	if changes.ActiveFrom != nil {
+		item.ActiveFrom = nil
+		if !changes.ActiveFrom.IsZero() {
+			item.ActiveFrom = changes.ActiveFrom
+		}
+		updates["active_from"] = item.ActiveFrom
+	}
+
+	if changes.PrelaunchUrl != nil {
+		item.PrelaunchUrl = *changes.PrelaunchUrl
+		updates["prelaunch_url"] = item.PrelaunchUrl
+	}
+
+	if changes.RedirectType != nil {
+		item.RedirectType = *changes.RedirectType
+		updates["redirect_type"] = item.RedirectType
+	}
+
+	if changes.QueryPassthrough != nil {
+		item.QueryPassthrough = *changes.QueryPassthrough
+		updates["query_passthrough"] = item.QueryPassthrough
+	}
+
+	if changes.Utm != nil {
+		item.Utm = *changes.Utm
+		updates["utm_source"] = item.Utm.Source
+		updates["utm_medium"] = item.Utm.Medium
+		updates["utm_campaign"] = item.Utm.Campaign
+		updates["utm_term"] = item.Utm.Term
+		updates["utm_content"] = item.Utm.Content
+	}
+
+	if changes.Rules != nil {
+		if err := validateRules(*changes.Rules); err != nil {
+			return nil, err
+		}
+
+		item.Rules = *changes.Rules
+		updates["rules"] = item.Rules
+	}
+
+	if changes.Variants != nil {
+		if err := validateVariants(*changes.Variants); err != nil {
+			return nil, err
+		}
+
+		item.Variants = *changes.Variants
+		updates["variants"] = item.Variants
+	}
+
+	if changes.SplitMode != nil {
+		item.SplitMode = *changes.SplitMode
+		updates["split_mode"] = item.SplitMode
+	}
+
+	if changes.DeepLink != nil {
+		if err := validateDeepLink(*changes.DeepLink); err != nil {
+			return nil, err
+		}
+
+		item.DeepLink = *changes.DeepLink
+		updates["deeplink_ios"] = item.DeepLink.Ios
+		updates["deeplink_ios_store"] = item.DeepLink.IosStore
+		updates["deeplink_android"] = item.DeepLink.Android
+		updates["deeplink_android_store"] = item.DeepLink.AndroidStore
+		updates["deeplink_web"] = item.DeepLink.Web
+	}
+
+	if changes.Title != nil {
+		item.Title = *changes.Title
+		updates["title"] = item.Title
+	}
+
+	if changes.Interstitial != nil {
+		item.Interstitial = *changes.Interstitial
+		updates["interstitial"] = item.Interstitial
+	}
+
+	state := changes.State
+	if state == nil && changes.Status != nil {
+		status := StateDeleted
+		if *changes.Status {
+			status = StateActive
+		}
+		state = &status
+	}
+
+	if from := item.stateOf(); state != nil && *state != from {
+		if !CanTransition(from, *state) || (len(owner) != 0 && (!ownerStates[from] || !ownerStates[*state])) {
+			return nil, errors.Wrapf(ErrInvalidTransition, "%s to %s", from, *state)
+		}
+
+		item.setState(*state, changes.Reason)
+		updates["state"] = item.State
+		updates["state_reason"] = item.StateReason
+		updates["status"] = item.Status
+		updates["deleted_at"] = item.DeletedAt
+	}
+
+	if err := validateSchedule(item.Expiry, item.ActiveFrom, item.PrelaunchUrl); err != nil {
+		return nil, err
+	}
+
+	if len(updates) == 0 {
+		return item, nil
+	}
+
+	updates["version"] = gorm.Expr("version + 1")
+	if err := u.db.Transaction(func(tx *gorm.DB) error {
+		// Another update may have been committed since the item was read
+		result := tx.Model(&Url{}).Where("`key` = ? AND version = ?", item.Key, item.Version).Updates(updates)
+		if result.Error != nil {
+			return errors.Wrap(result.Error, "tx.Updates")
+		}
+		if result.RowsAffected == 0 {
+			return ErrVersionConflict
+		}
+
+		item.Version++
+		if err := tx.Create(newRevision(*item, changes.Actor, changes.Reason)).Error; err != nil {
+			return errors.Wrap(err, "tx.Create")
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := u.cacheItem(*item); err != nil {
+		u.log.With(zap.Error(err)).Error("u.cacheItem")
+
+		// Readers go to the database rather than to the previous item
+		if err := u.redis.Del(context.Background(), item.GetCacheKey()).Err(); err != nil {
+			u.log.With(zap.Error(err)).Error("u.redis.Del")
+		}
+	}
+
+	return item, nil
+}
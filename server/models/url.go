@@ -2,13 +2,12 @@ package models
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"strings"
 	"time"
 
-	"codeberg.org/ac/base62"
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -22,20 +21,97 @@ var (
 	ErrExpired  = errors.New("Expired")
 )
 
+// Number of attempts to find a free short code before giving up
+const maxGenerateAttempts = 5
+
+// aliasFoldIndex makes the aliases unique regardless of their case
+const aliasFoldIndex = "idx_urls_alias_fold"
+
 type Url struct {
-	ID        int        `gorm:"primaryKey;autoIncrement" json:"id"`
-	Key       string     `gorm:"index;not null;unique" json:"short_code"`
-	Origin    string     `gorm:"not null" json:"origin_url"`
-	Hits      uint       `gorm:"default:0" json:"hits"`
-	Expiry    *time.Time `json:"expiry"`
-	CreatedAt time.Time  `gorm:"autoCreateTime" json:"-"`
-	Status    bool       `gorm:"default:1" json:"status"`
+	ID               int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	Key              string     `gorm:"index;not null;unique" json:"short_code"`
+	KeyFold          string     `gorm:"index" json:"-"` // Lower-cased key for case-insensitive lookups
+	AliasFold        *string    `json:"-"`              // Lower-cased key of aliases only, unique once indexed
+	Custom           bool       `gorm:"default:0" json:"custom"`
+	Origin           string     `gorm:"not null" json:"origin_url"`
+	OriginHash       string     `gorm:"index;size:64" json:"-"` // Hash of the normalized origin for dedupe
+	Owner            string     `gorm:"index;size:64" json:"owner,omitempty"`
+	PasswordHash     string     `gorm:"size:72" json:"-"` // Never cached, read when checking a password
+	Protected        bool       `gorm:"default:0" json:"protected"`
+	MaxClicks        *uint      `json:"max_clicks,omitempty"`                   // Redirects allowed before the item is gone
+	ClickCount       uint       `gorm:"default:0" json:"click_count,omitempty"` // Redirects counted against MaxClicks
+	Hits             uint       `gorm:"default:0" json:"hits"`
+	UniqueVisitors   uint64     `gorm:"-" json:"unique_visitors"` // Read from redis, only set on listed items
+	Expiry           *time.Time `json:"expiry"`
+	ActiveFrom       *time.Time `json:"active_from,omitempty"`
+	PrelaunchUrl     string     `json:"prelaunch_url,omitempty"` // Destination of the redirects before ActiveFrom
+	RedirectType     string     `gorm:"size:8;not null;default:''" json:"redirect_type,omitempty"`
+	QueryPassthrough string     `gorm:"size:16;not null;default:''" json:"query_passthrough,omitempty"`
+	Utm              UtmParams  `gorm:"embedded;embeddedPrefix:utm_" json:"utm"`
+	// Rules are evaluated in order before falling back to the origin
+	Rules RedirectRules `gorm:"type:text" json:"rules,omitempty"`
+	// Variants split the visitors matching no rule between destinations
+	Variants  Variants `gorm:"type:text" json:"variants,omitempty"`
+	SplitMode string   `gorm:"size:8;not null;default:''" json:"split_mode,omitempty"`
+	// DeepLink opens the app of the item on mobiles
+	DeepLink DeepLink `gorm:"embedded;embeddedPrefix:deeplink_" json:"deep_link"`
+	// Title is shown on the preview page of the item
+	Title string `gorm:"size:255;not null;default:''" json:"title,omitempty"`
+	// Interstitial shows the preview page before every redirect
+	Interstitial bool       `gorm:"not null;default:false" json:"interstitial"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	Status       bool       `gorm:"default:1" json:"status"` // Whether the state lets the item redirect
+	State        LinkState  `gorm:"size:16;index;not null;default:active" json:"state"`
+	StateReason  string     `gorm:"size:255" json:"state_reason,omitempty"` // Reason of the last state change
+	Version      uint       `gorm:"default:1;not null" json:"version"`      // Incremented by every update
+	DeletedAt    *time.Time `gorm:"index" json:"deleted_at,omitempty"`      // Set while deleted, purged after the retention
+}
+
+// GenerateOptions are the optional settings of a new shorten item
+type GenerateOptions struct {
+	Expire *time.Time
+	// ActiveFrom delays the activation of the item, before it PrelaunchUrl is
+	// used when set
+	ActiveFrom   *time.Time
+	PrelaunchUrl string
+	// Alias is used as short code instead of a generated one
+	Alias string
+	// Owner is the name of the api key owner creating the item
+	Owner string
+	// Password protects the item, only its hash is stored
+	Password string
+	// MaxClicks limits the redirects of the item, 0 means unlimited
+	MaxClicks uint
+	// RedirectType, QueryPassthrough and Utm shape the redirects of the item
+	RedirectType     string
+	QueryPassthrough string
+	Utm              UtmParams
+	// Rules send the visitors matching their conditions to other targets
+	Rules RedirectRules
+	// Variants split the visitors by weight, SplitMode picks how
+	Variants  Variants
+	SplitMode string
+	DeepLink  DeepLink
+	// Title is shown on the preview page, Interstitial shows it before every redirect
+	Title        string
+	Interstitial bool
+}
+
+// Targets lists the destinations of an item created to origin with the
+// options, callers check them against the blacklist
+func (opts GenerateOptions) Targets(origin string) []string {
+	return append([]string{origin}, routingTargets(opts.Rules, opts.Variants, opts.DeepLink)...)
 }
 
 func (u Url) GetCacheKey() string {
 	return strings.Join([]string{"item", u.Key}, "-")
 }
 
+// QrCacheKey is the hash of the QR codes rendered for a code
+func QrCacheKey(code string) string {
+	return strings.Join([]string{"qr", code}, "-")
+}
+
 // Marshall will encode item into JSON string
 func (u Url) Marshall() (string, error) {
 	b, err := json.Marshal(u)
@@ -54,47 +130,85 @@ func (u *Url) Unmarshall(encoded string) error {
 	return nil
 }
 
-func (u Url) IsExpired() bool {
-	return !u.Status || (u.Expiry != nil && time.Now().After(*u.Expiry))
-}
-
 type UrlModel struct {
-	redis *redis.Client
-	db    *gorm.DB
-	log   *zap.Logger
+	redis  *redis.Client
+	db     *gorm.DB
+	log    *zap.Logger
+	codes  CodeGenerator
+	ids    *IDAllocator
+	secret visitorsSecret
 }
 
 func (u *UrlModel) Generate(url string, expire *time.Time) (*Url, error) {
+	return u.GenerateWithOptions(url, GenerateOptions{Expire: expire})
+}
+
+func (u *UrlModel) GenerateWithOptions(url string, opts GenerateOptions) (*Url, error) {
 	item := Url{
-		Origin: url,
-		Status: true,
-		Key:    uuid.NewString(), // Key as temporary
+		Origin:           url,
+		OriginHash:       HashOrigin(url),
+		Owner:            opts.Owner,
+		Status:           true,
+		RedirectType:     opts.RedirectType,
+		QueryPassthrough: opts.QueryPassthrough,
+		Utm:              opts.Utm,
+		Rules:            opts.Rules,
+		Variants:         opts.Variants,
+		SplitMode:        opts.SplitMode,
+		DeepLink:         opts.DeepLink,
+		Title:            opts.Title,
+		Interstitial:     opts.Interstitial,
+		State:            StateActive,
+		Version:          1,
 	}
 
-	if expire != nil {
-		if time.Now().After(*expire) {
+	if opts.Expire != nil {
+		if time.Now().After(*opts.Expire) {
 			return nil, errors.New("expire time is invalid")
 		}
 
-		item.Expiry = expire
+		item.Expiry = opts.Expire
 	}
 
-	if err := u.db.Transaction(func(tx *gorm.DB) error {
-		if result := u.db.Create(&item); result.Error != nil {
-			return errors.Wrap(result.Error, "u.db.Create")
-		}
+	if err := validateSchedule(opts.Expire, opts.ActiveFrom, opts.PrelaunchUrl); err != nil {
+		return nil, err
+	}
+	if err := validateRules(opts.Rules); err != nil {
+		return nil, err
+	}
 
-		// Generate short-code based on id
-		item.Key = base62.Encode(uint32(item.ID + idBuffer))
+	if err := validateVariants(opts.Variants); err != nil {
+		return nil, err
+	}
+
+	if err := validateDeepLink(opts.DeepLink); err != nil {
+		return nil, err
+	}
+
+	item.ActiveFrom = opts.ActiveFrom
+	item.PrelaunchUrl = opts.PrelaunchUrl
 
-		// Update item
-		if result := u.db.Model(&item).Update("key", item.Key); result.Error != nil {
-			return errors.Wrap(result.Error, "u.db.Update")
+	if opts.MaxClicks != 0 {
+		item.MaxClicks = &opts.MaxClicks
+	}
+
+	if len(opts.Password) != 0 {
+		hash, err := hashPassword(opts.Password)
+		if err != nil {
+			return nil, err
 		}
+		item.PasswordHash = hash
+		item.Protected = true
+	}
 
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "u.db.Transaction")
+	var err error
+	if len(opts.Alias) != 0 {
+		err = u.createWithAlias(&item, opts.Alias)
+	} else {
+		err = u.createWithGeneratedKey(&item)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if err := u.cacheItem(item); err != nil {
@@ -104,6 +218,125 @@ func (u *UrlModel) Generate(url string, expire *time.Time) (*Url, error) {
 	return &item, nil
 }
 
+func (u *UrlModel) createWithAlias(item *Url, alias string) error {
+	if !ValidAlias(alias) {
+		return ErrAliasInvalid
+	}
+
+	if IsReservedAlias(alias) {
+		return ErrAliasReserved
+	}
+
+	id, err := u.ids.Next(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "u.ids.Next")
+	}
+
+	item.ID = int(id)
+	item.Key = alias
+	item.KeyFold = strings.ToLower(alias)
+	item.AliasFold = &item.KeyFold
+	item.Custom = true
+
+	// Aliases are unique regardless of their case, against every existing code
+	var count int64
+	if result := u.db.Model(&Url{}).Where("key_fold = ?", item.KeyFold).Count(&count); result.Error != nil {
+		return errors.Wrap(result.Error, "u.db.Count")
+	}
+	if count != 0 {
+		return ErrAliasTaken
+	}
+
+	if tombstoned, err := u.isTombstoned(alias); err != nil {
+		return err
+	} else if tombstoned {
+		return ErrAliasTaken
+	}
+
+	// The unique index on the folded alias refuses the concurrent creations
+	// passing the count above
+	if err := u.insert(item); err != nil {
+		if taken, err := u.isKeyTaken(item.Key); err == nil && taken {
+			return ErrAliasTaken
+		}
+		return err
+	}
+
+	return nil
+}
+
+// insert stores a new item along with its first revision, so it can always
+// be rolled back to the version it was created with
+func (u *UrlModel) insert(item *Url) error {
+	return u.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(item); result.Error != nil {
+			return errors.Wrap(result.Error, "tx.Create")
+		}
+
+		if result := tx.Create(newRevision(*item, item.Owner, ReasonCreate)); result.Error != nil {
+			return errors.Wrap(result.Error, "tx.Create revision")
+		}
+
+		return nil
+	})
+}
+
+// createWithGeneratedKey stores the item with the code of a newly allocated
+// id, in a single INSERT. Ids whose code is taken are skipped.
+func (u *UrlModel) createWithGeneratedKey(item *Url) error {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		id, err := u.ids.Next(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "u.ids.Next")
+		}
+
+		// Generate short-code based on id
+		key, err := u.codes.Code(id, attempt)
+		if err != nil {
+			return errors.Wrap(err, "u.codes.Code")
+		}
+
+		taken, err := u.isKeyTaken(key)
+		if err != nil {
+			return err
+		}
+		if taken {
+			continue
+		}
+
+		item.ID = int(id)
+		item.Key = key
+		item.KeyFold = strings.ToLower(key)
+		if err := u.insert(item); err != nil {
+			// Another instance may have stored the same random code meanwhile
+			if taken, err := u.isKeyTaken(key); err == nil && taken {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+
+	return errors.New("can not find a free short code")
+}
+
+// isKeyTaken reports whether a generated code is already used, shadows an
+// alias whatever its case, or was used by a purged item
+func (u *UrlModel) isKeyTaken(key string) (bool, error) {
+	var count int64
+	if result := u.db.Model(&Url{}).
+		Where("`key` = ? OR (key_fold = ? AND custom = ?)", key, strings.ToLower(key), true).
+		Count(&count); result.Error != nil {
+		return false, errors.Wrap(result.Error, "u.db.Count")
+	}
+	if count != 0 {
+		return true, nil
+	}
+
+	return u.isTombstoned(key)
+}
+
 func (u *UrlModel) cacheItem(item Url) error {
 	// Cache data
 	cache, err := item.Marshall()
@@ -123,16 +356,29 @@ func (u *UrlModel) cacheItem(item Url) error {
 	return nil
 }
 
-func (u *UrlModel) hitItem(shortCode string) error {
-	// Hit the item
-	if result := u.db.Model(&Url{}).Where("`key` = ?", shortCode).UpdateColumn("hits", gorm.Expr("hits + ?", 1)); result.Error != nil {
-		return errors.Wrap(result.Error, "u.db.Where.UpdateColumn")
+func (u *UrlModel) FindByShortCode(shortCode string, hit bool) (*Url, error) {
+	item, err := u.lookup(shortCode)
+	if err != nil {
+		return item, err
 	}
 
-	return nil
+	if hit {
+		// Counting is best effort, it must never fail the redirect
+		if err := u.Hit(shortCode); err != nil {
+			u.log.With(zap.Error(err), zap.String("code", shortCode)).Error("u.Hit")
+		}
+	}
+
+	if err := u.mergePendingHits([]*Url{item}); err != nil {
+		u.log.With(zap.Error(err), zap.String("code", shortCode)).Error("u.mergePendingHits")
+	}
+
+	return item, nil
 }
 
-func (u *UrlModel) FindByShortCode(shortCode string, hit bool) (*Url, error) {
+// lookup finds an item from the cache, then from the database. Items which
+// are not active are returned along with the error of their state.
+func (u *UrlModel) lookup(shortCode string) (*Url, error) {
 	item := &Url{
 		Key: shortCode,
 	}
@@ -147,12 +393,8 @@ func (u *UrlModel) FindByShortCode(shortCode string, hit bool) (*Url, error) {
 			return nil, errors.Wrap(err, "item.Unmarshall")
 		}
 
-		if item.IsExpired() {
-			return item, ErrExpired
-		}
-
-		if err := u.hitItem(shortCode); err != nil {
-			return nil, errors.Wrap(err, "u.hitItem")
+		if err := item.Evaluate(time.Now()).Err(); err != nil {
+			return item, err
 		}
 
 		return item, nil
@@ -166,14 +408,8 @@ func (u *UrlModel) FindByShortCode(shortCode string, hit bool) (*Url, error) {
 		return nil, errors.Wrap(result.Error, "FindByShortCode")
 	}
 
-	if item.IsExpired() {
-		return item, ErrExpired
-	}
-
-	if hit {
-		if err := u.hitItem(shortCode); err != nil {
-			return nil, errors.Wrap(err, "u.hitItem")
-		}
+	if err := item.Evaluate(time.Now()).Err(); err != nil {
+		return item, err
 	}
 
 	if err := u.cacheItem(*item); err != nil {
@@ -183,51 +419,212 @@ func (u *UrlModel) FindByShortCode(shortCode string, hit bool) (*Url, error) {
 	return item, nil
 }
 
-func (u *UrlModel) Delete(shortCode string) (bool, error) {
-	item, err := u.FindByShortCode(shortCode, false)
-	if err != nil {
-		return false, errors.Wrap(err, "u.FindByShortCode")
+// Consume counts a redirect of an item limited by MaxClicks. The conditional
+// update keeps instances from going over the limit together, ErrExpired is
+// returned once every click is used.
+func (u *UrlModel) Consume(item *Url) error {
+	if item.MaxClicks == nil {
+		return nil
 	}
 
-	item.Status = false
-	if result := u.db.Save(item); result.Error != nil {
-		return false, errors.Wrap(result.Error, "u.db.Save")
+	result := u.db.Model(&Url{}).
+		Where("`key` = ? AND click_count < max_clicks", item.Key).
+		UpdateColumn("click_count", gorm.Expr("click_count + 1"))
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "u.db.UpdateColumn")
 	}
 
-	if err := u.cacheItem(*item); err != nil {
-		u.log.With(zap.Error(err)).Error("u.cacheItem")
+	// The cached item holds the previous count
+	if err := u.redis.Del(context.Background(), item.GetCacheKey()).Err(); err != nil {
+		u.log.With(zap.Error(err)).Error("u.redis.Del")
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrExpired
+	}
+
+	item.ClickCount++
+	return nil
+}
+
+// Delete moves an item to the deleted state, recording the actor in its
+// history
+func (u *UrlModel) Delete(shortCode, actor string) (bool, error) {
+	state := StateDeleted
+	if _, err := u.Update(shortCode, "", 0, UrlChanges{State: &state, Actor: actor, Reason: ReasonDelete}); err != nil {
+		return false, errors.Wrap(err, "u.Update")
 	}
 
 	return true, nil
 }
 
 func (u *UrlModel) GetList(shortCode, keywords string) ([]Url, error) {
+	var results []Url
+	if err := u.listQuery(shortCode, keywords).Find(&results).Error; err != nil {
+		return nil, errors.Wrap(err, "model.Find")
+	}
+
+	items := make([]*Url, len(results))
+	for i := range results {
+		items[i] = &results[i]
+	}
+	u.mergeCounters(items)
+
+	return results, nil
+}
+
+// Iterate returns an iterator over the items matching the criteria, reading
+// rows one at a time instead of loading them all into memory. The rows stop
+// when the context is done.
+func (u *UrlModel) Iterate(ctx context.Context, shortCode, keywords string) (*UrlIterator, error) {
+	rows, err := u.listQuery(shortCode, keywords).WithContext(ctx).Order("id").Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "model.Rows")
+	}
+
+	return &UrlIterator{model: u, rows: rows}, nil
+}
+
+func (u *UrlModel) listQuery(shortCode, keywords string) *gorm.DB {
 	model := u.db.Model(&Url{})
 	if len(shortCode) != 0 {
-		model.Where("`key` = ?", shortCode)
+		model = model.Where("`key` = ?", shortCode)
 	}
 
 	if len(keywords) != 0 {
-		model.Where("origin LIKE ?", strings.Join([]string{"%", keywords, "%"}, ""))
+		model = model.Where("origin LIKE ?", strings.Join([]string{"%", keywords, "%"}, ""))
 	}
 
-	var results []Url
-	if err := model.Find(&results).Error; err != nil {
-		return nil, errors.Wrap(err, "model.Find")
+	return model
+}
+
+// Number of rows an iterator reads ahead to merge their pending hits at once
+const iteratorBatchSize = 100
+
+// UrlIterator walks over the rows of a list query
+type UrlIterator struct {
+	model *UrlModel
+	rows  *sql.Rows
+	batch []Url
+	pos   int
+	err   error
+}
+
+func (it *UrlIterator) Next() bool {
+	it.pos++
+	if it.pos < len(it.batch) {
+		return true
 	}
 
-	return results, nil
+	if it.err != nil {
+		return false
+	}
+
+	// Read the next batch of rows
+	it.batch, it.pos = it.batch[:0], 0
+	for len(it.batch) < iteratorBatchSize && it.rows.Next() {
+		item := Url{}
+		if err := it.model.db.ScanRows(it.rows, &item); err != nil {
+			it.err = errors.Wrap(err, "db.ScanRows")
+			return false
+		}
+		it.batch = append(it.batch, item)
+	}
+
+	if len(it.batch) == 0 {
+		return false
+	}
+
+	items := make([]*Url, len(it.batch))
+	for i := range it.batch {
+		items[i] = &it.batch[i]
+	}
+	it.model.mergeCounters(items)
+
+	return true
+}
+
+func (it *UrlIterator) Value() interface{} {
+	return it.batch[it.pos]
+}
+
+func (it *UrlIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.rows.Err()
+}
+
+func (it *UrlIterator) Close() error {
+	return it.rows.Close()
 }
 
 func NewUrlModel(log *zap.Logger, redis *redis.Client, db *gorm.DB) (*UrlModel, error) {
+	// The columns added by the migration are backfilled once, right after
+	// they are created
+	hasState := db.Migrator().HasColumn(&Url{}, "state")
+	hasDeletedAt := db.Migrator().HasColumn(&Url{}, "deleted_at")
+
 	// Automatically migrate model into db layer
-	if err := db.AutoMigrate(&Url{}); err != nil {
+	if err := db.AutoMigrate(&Url{}, &UrlRevision{}, &Tombstone{}); err != nil {
 		return nil, errors.Wrap(err, "NewUrlModel.AutoMigrate")
 	}
 
+	codes, err := NewCodeGeneratorFromViper()
+	if err != nil {
+		return nil, errors.Wrap(err, "NewCodeGeneratorFromViper")
+	}
+
+	ids, err := NewIDAllocatorFromViper(redis, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewIDAllocatorFromViper")
+	}
+
+	// Fill the folded key of rows created before aliases existed
+	if err := db.Model(&Url{}).Where("key_fold IS NULL OR key_fold = ''").
+		UpdateColumn("key_fold", gorm.Expr("LOWER(`key`)")).Error; err != nil {
+		return nil, errors.Wrap(err, "NewUrlModel.UpdateColumn")
+	}
+
+	// Aliases are unique regardless of their case, generated codes differing
+	// by case only share their folded key. The index is created once the
+	// aliases created before it are filled.
+	if !db.Migrator().HasIndex(&Url{}, aliasFoldIndex) {
+		if err := db.Model(&Url{}).Where("custom = ? AND alias_fold IS NULL", true).
+			UpdateColumn("alias_fold", gorm.Expr("key_fold")).Error; err != nil {
+			return nil, errors.Wrap(err, "NewUrlModel.UpdateColumn")
+		}
+		if err := db.Exec("CREATE UNIQUE INDEX " + aliasFoldIndex + " ON urls (alias_fold)").Error; err != nil {
+			return nil, errors.Wrap(err, "NewUrlModel.CreateIndex")
+		}
+	}
+
+	// Items disabled before states existed were deleted
+	if !hasState {
+		if err := db.Model(&Url{}).Where("status = ? AND (state IS NULL OR state = '' OR state = ?)", false, StateActive).
+			UpdateColumn("state", StateDeleted).Error; err != nil {
+			return nil, errors.Wrap(err, "NewUrlModel.UpdateColumn")
+		}
+		if err := db.Model(&Url{}).Where("state IS NULL OR state = ''").
+			UpdateColumn("state", StateActive).Error; err != nil {
+			return nil, errors.Wrap(err, "NewUrlModel.UpdateColumn")
+		}
+	}
+
+	// Start the retention of the items deleted before it existed
+	if !hasDeletedAt {
+		if err := db.Model(&Url{}).Where("state = ? AND deleted_at IS NULL", StateDeleted).
+			UpdateColumn("deleted_at", time.Now()).Error; err != nil {
+			return nil, errors.Wrap(err, "NewUrlModel.UpdateColumn")
+		}
+	}
+
 	return &UrlModel{
 		redis: redis,
 		db:    db,
 		log:   log,
+		codes: codes,
+		ids:   ids,
 	}, nil
 }
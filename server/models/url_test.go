@@ -3,13 +3,18 @@ package models
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -23,6 +28,7 @@ type testCases struct {
 	t     *testing.T
 	log   *zap.Logger
 	redis *redis.Client
+	mr    *miniredis.Miniredis
 	db    *gorm.DB
 	model *UrlModel
 }
@@ -83,11 +89,51 @@ func (c testCases) testFindByShortCode() {
 	assert.Equal(c.t, lookup.ID, cache.ID)
 	assert.Equal(c.t, lookup.Key, cache.Key)
 
-	c.log.Debug("The item should increase hit on db")
+	c.log.Debug("The hit is pending in redis, merged on read")
+	assert.Equal(c.t, uint(1), lookup.Hits)
 	dbItem := Url{}
 	result := c.db.Model(&Url{}).Where("key = ?", lookup.Key).First(&dbItem)
 	require.NoError(c.t, result.Error)
-	assert.Greater(c.t, dbItem.Hits, lookup.Hits)
+	assert.Equal(c.t, uint(0), dbItem.Hits)
+
+	c.log.Debug("Flush should write pending hits on db")
+	_, err = c.model.FindByShortCode(item.Key, true)
+	require.NoError(c.t, err)
+	flusher := NewHitFlusher(c.log, c.redis, c.db)
+	require.NoError(c.t, flusher.Flush(context.Background()))
+	result = c.db.Model(&Url{}).Where("key = ?", lookup.Key).First(&dbItem)
+	require.NoError(c.t, result.Error)
+	assert.Equal(c.t, uint(2), dbItem.Hits)
+	assert.Equal(c.t, int64(0), c.redis.Exists(context.Background(), pendingHitsKey(item.Key), inflightHitsKey(item.Key)).Val())
+
+	c.log.Debug("Flushed hits should not be counted twice")
+	lookup, err = c.model.FindByShortCode(item.Key, true)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, uint(3), lookup.Hits)
+
+	c.log.Debug("Hits left inflight by a failed flush are written by the next one")
+	require.NoError(c.t, c.redis.Set(context.Background(), inflightHitsKey(item.Key), 4, 0).Err())
+	require.NoError(c.t, c.redis.SAdd(context.Background(), hitsInflightSet, item.Key).Err())
+	require.NoError(c.t, flusher.Flush(context.Background()))
+	result = c.db.Model(&Url{}).Where("key = ?", lookup.Key).First(&dbItem)
+	require.NoError(c.t, result.Error)
+	assert.Equal(c.t, uint(7), dbItem.Hits)
+
+	c.log.Debug("Flush leaves the lock of another instance alone")
+	ctx := context.Background()
+	require.NoError(c.t, c.model.Hit(item.Key))
+	require.NoError(c.t, c.redis.Set(ctx, hitsFlushLock, "other", time.Minute).Err())
+	require.NoError(c.t, flusher.Flush(ctx))
+	assert.Equal(c.t, "other", c.redis.Get(ctx, hitsFlushLock).Val())
+	assert.Equal(c.t, int64(1), c.redis.Exists(ctx, pendingHitsKey(item.Key)).Val())
+	require.NoError(c.t, c.redis.Del(ctx, hitsFlushLock).Err())
+
+	c.log.Debug("Flush releases its own lock")
+	require.NoError(c.t, flusher.Flush(ctx))
+	assert.Equal(c.t, int64(0), c.redis.Exists(ctx, hitsFlushLock).Val())
+	result = c.db.Model(&Url{}).Where("key = ?", lookup.Key).First(&dbItem)
+	require.NoError(c.t, result.Error)
+	assert.Equal(c.t, uint(8), dbItem.Hits)
 
 	c.log.Debug("Clear cache item on redis, should get from db instead")
 	_, err = c.redis.Del(context.Background(), lookup.GetCacheKey()).Result()
@@ -121,7 +167,7 @@ func (c testCases) testDeleteItem() {
 	require.NoError(c.t, err)
 
 	c.log.Debug("Delete item by short code")
-	ok, err := c.model.Delete(item.Key)
+	ok, err := c.model.Delete(item.Key, "admin")
 	require.NoError(c.t, err)
 	assert.True(c.t, ok)
 
@@ -170,6 +216,687 @@ func (c testCases) testGetListItem() {
 	require.NoError(c.t, err)
 	assert.Equal(c.t, len(items), 1)
 	assert.Equal(c.t, items[0].ID, item2.ID)
+
+	c.log.Debug("Iterate over all items")
+	it, err := c.model.Iterate(context.Background(), "", "")
+	require.NoError(c.t, err)
+	var ids []int
+	for it.Next() {
+		ids = append(ids, it.Value().(Url).ID)
+	}
+	require.NoError(c.t, it.Err())
+	require.NoError(c.t, it.Close())
+	assert.Equal(c.t, []int{item1.ID, item2.ID}, ids)
+}
+
+func (c testCases) testAlias() {
+	c.log.Debug("Generate new shorten item with alias")
+	item, err := c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: "q3-Report"})
+	require.NoError(c.t, err)
+	assert.Equal(c.t, "q3-Report", item.Key)
+	assert.True(c.t, item.Custom)
+
+	lookup, err := c.model.FindByShortCode("q3-Report", false)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, item.ID, lookup.ID)
+
+	c.log.Debug("Alias is unique regardless of its case")
+	_, err = c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: "Q3-REPORT"})
+	assert.True(c.t, errors.Is(err, ErrAliasTaken))
+
+	c.log.Debug("Concurrent aliases differing by case, only one is created")
+	var wg sync.WaitGroup
+	var created, taken int32
+	for _, alias := range []string{"Q4-Report", "q4-report", "Q4-REPORT", "q4-Report", "q4-REPORT", "Q4-report"} {
+		wg.Add(1)
+		go func(alias string) {
+			defer wg.Done()
+			_, err := c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: alias})
+			switch {
+			case err == nil:
+				atomic.AddInt32(&created, 1)
+			case errors.Is(err, ErrAliasTaken):
+				atomic.AddInt32(&taken, 1)
+			default:
+				c.t.Error(err)
+			}
+		}(alias)
+	}
+	wg.Wait()
+	assert.Equal(c.t, int32(1), created)
+	assert.Equal(c.t, int32(5), taken)
+
+	c.log.Debug("Reserved words are refused")
+	_, err = c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: "Admin"})
+	assert.True(c.t, errors.Is(err, ErrAliasReserved))
+
+	c.log.Debug("Alias outside of the charset is refused")
+	_, err = c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: "q3 report"})
+	assert.True(c.t, errors.Is(err, ErrAliasInvalid))
+	_, err = c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: "ab"})
+	assert.True(c.t, errors.Is(err, ErrAliasInvalid))
+
+	c.log.Debug("Generated codes skip the ones taken by an alias")
+	next, err := c.model.Generate("http://google.com", nil)
+	require.NoError(c.t, err)
+	// The alias takes the next id, so the clash happens on the one after
+	nextKey, err := c.model.codes.Code(uint64(next.ID+2), 0)
+	require.NoError(c.t, err)
+	_, err = c.model.GenerateWithOptions("http://google.com", GenerateOptions{Alias: strings.ToLower(nextKey)})
+	require.NoError(c.t, err)
+	generated, err := c.model.Generate("http://google.com", nil)
+	require.NoError(c.t, err)
+	assert.NotEqual(c.t, strings.ToLower(nextKey), strings.ToLower(generated.Key))
+	assert.Equal(c.t, next.ID+3, generated.ID)
+}
+
+func (c testCases) testDedupe() {
+	c.log.Debug("Normalized destinations compare equal")
+	a, err := NormalizeUrl("HTTP://Example.com:80?b=2&a=1")
+	require.NoError(c.t, err)
+	b, err := NormalizeUrl("http://example.com/?a=1&b=2")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, a, b)
+
+	c.log.Debug("No reusable item for a new destination")
+	opts := GenerateOptions{Owner: "marketing"}
+	_, err = c.model.FindReusable("http://dedupe.com/page", opts)
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+
+	item, err := c.model.GenerateWithOptions("http://dedupe.com/page", opts)
+	require.NoError(c.t, err)
+
+	c.log.Debug("Same destination and settings is reused")
+	reused, err := c.model.FindReusable("http://DEDUPE.com:80/page", opts)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, item.ID, reused.ID)
+
+	c.log.Debug("Other owner or expiry is not reused")
+	_, err = c.model.FindReusable("http://dedupe.com/page", GenerateOptions{Owner: "sales"})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+	expire := time.Now().Add(time.Hour)
+	_, err = c.model.FindReusable("http://dedupe.com/page", GenerateOptions{Owner: "marketing", Expire: &expire})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+
+	c.log.Debug("Deleted item is not reused")
+	_, err = c.model.Delete(item.Key, "admin")
+	require.NoError(c.t, err)
+	_, err = c.model.FindReusable("http://dedupe.com/page", opts)
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+}
+
+func (c testCases) testPassword() {
+	c.log.Debug("Generate protected item, only the hash is stored")
+	item, err := c.model.GenerateWithOptions("http://docs.internal.com", GenerateOptions{Password: "s3cret"})
+	require.NoError(c.t, err)
+	assert.True(c.t, item.Protected)
+	assert.NotContains(c.t, item.PasswordHash, "s3cret")
+
+	c.log.Debug("The cache entry never contains the hash")
+	cacheString := c.redis.Get(context.Background(), item.GetCacheKey()).Val()
+	assert.NotContains(c.t, cacheString, item.PasswordHash)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	assert.True(c.t, lookup.Protected)
+	assert.Empty(c.t, lookup.PasswordHash)
+
+	c.log.Debug("Check password of the cached item")
+	assert.True(c.t, errors.Is(c.model.CheckPassword(lookup, ""), ErrPasswordRequired))
+	assert.True(c.t, errors.Is(c.model.CheckPassword(lookup, "wrong"), ErrPasswordInvalid))
+	require.NoError(c.t, c.model.CheckPassword(lookup, "s3cret"))
+
+	c.log.Debug("Failed attempts lock the item")
+	for i := 1; i < viper.GetInt(keyPasswordMaxAttempts); i++ {
+		assert.True(c.t, errors.Is(c.model.CheckPassword(lookup, "wrong"), ErrPasswordInvalid))
+	}
+	assert.True(c.t, errors.Is(c.model.CheckPassword(lookup, "s3cret"), ErrTooManyAttempts))
+
+	c.log.Debug("Refused attempts don't extend the lockout")
+	key := passwordFailuresKey(item.Key)
+	ttl := c.redis.PTTL(context.Background(), key).Val()
+	assert.True(c.t, ttl > 0)
+	c.mr.FastForward(time.Second)
+	assert.True(c.t, errors.Is(c.model.CheckPassword(lookup, "wrong"), ErrTooManyAttempts))
+	assert.True(c.t, c.redis.PTTL(context.Background(), key).Val() < ttl)
+	c.mr.FastForward(viper.GetDuration(keyPasswordLockout))
+	require.NoError(c.t, c.model.CheckPassword(lookup, "s3cret"))
+
+	c.log.Debug("Parallel guesses can't pass the limit")
+	var wg sync.WaitGroup
+	var invalid int32
+	for i := 0; i < 4*viper.GetInt(keyPasswordMaxAttempts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errors.Is(c.model.CheckPassword(lookup, "wrong"), ErrPasswordInvalid) {
+				atomic.AddInt32(&invalid, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(c.t, int32(viper.GetInt(keyPasswordMaxAttempts)), invalid)
+
+	c.log.Debug("Protected items are never reused")
+	_, err = c.model.FindReusable("http://docs.internal.com", GenerateOptions{})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+}
+
+func (c testCases) testMaxClicks() {
+	c.log.Debug("Generate one-time item")
+	item, err := c.model.GenerateWithOptions("http://once.com", GenerateOptions{MaxClicks: 1})
+	require.NoError(c.t, err)
+	require.NotNil(c.t, item.MaxClicks)
+
+	c.log.Debug("First click is consumed, the item is gone afterwards")
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	require.NoError(c.t, c.model.Consume(lookup))
+	assert.True(c.t, errors.Is(c.model.Consume(lookup), ErrExpired))
+	_, err = c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrExpired))
+
+	c.log.Debug("Concurrent clicks never go over the limit")
+	item, err = c.model.GenerateWithOptions("http://limited.com", GenerateOptions{MaxClicks: 3})
+	require.NoError(c.t, err)
+	var consumed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.model.Consume(item); err == nil {
+				atomic.AddInt32(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(c.t, int32(3), consumed)
+
+	c.log.Debug("Limited items are never reused")
+	_, err = c.model.FindReusable("http://limited.com", GenerateOptions{})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+}
+
+func (c testCases) testActiveFrom() {
+	c.log.Debug("Generate scheduled item, it is not active before its time")
+	activeFrom := time.Now().Add(time.Hour)
+	item, err := c.model.GenerateWithOptions("http://launch.com", GenerateOptions{ActiveFrom: &activeFrom, PrelaunchUrl: "http://launch.com/soon"})
+	require.NoError(c.t, err)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrNotActive))
+	require.NotNil(c.t, lookup)
+	assert.Equal(c.t, "http://launch.com/soon", lookup.PrelaunchUrl)
+
+	c.log.Debug("The database path evaluates the same lifecycle")
+	require.NoError(c.t, c.redis.Del(context.Background(), item.GetCacheKey()).Err())
+	_, err = c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrNotActive))
+
+	c.log.Debug("Lifecycle of the item over time")
+	assert.Equal(c.t, StateScheduled, item.Evaluate(time.Now()))
+	assert.Equal(c.t, StateActive, item.Evaluate(activeFrom.Add(time.Minute)))
+	expire := activeFrom.Add(time.Hour)
+	item.Expiry = &expire
+	assert.Equal(c.t, StateExpired, item.Evaluate(expire.Add(time.Minute)))
+	item.State = StateDeleted
+	assert.Equal(c.t, StateDeleted, item.Evaluate(time.Now()))
+
+	c.log.Debug("Activation time must be before expire time")
+	_, err = c.model.GenerateWithOptions("http://launch.com", GenerateOptions{ActiveFrom: &expire, Expire: &activeFrom})
+	assert.Error(c.t, err)
+	_, err = c.model.GenerateWithOptions("http://launch.com", GenerateOptions{PrelaunchUrl: "http://launch.com/soon"})
+	assert.Error(c.t, err)
+}
+
+func (c testCases) testUpdate() {
+	item, err := c.model.Generate("http://typo.con", nil)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, uint(1), item.Version)
+
+	c.log.Debug("Update destination and expiry of an item, the cache follows")
+	origin := "http://typo.com"
+	expire := time.Now().Add(time.Hour)
+	updated, err := c.model.Update(item.Key, "", 1, UrlChanges{Origin: &origin, Expire: &expire})
+	require.NoError(c.t, err)
+	assert.Equal(c.t, uint(2), updated.Version)
+	assert.Equal(c.t, HashOrigin(origin), updated.OriginHash)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, origin, lookup.Origin)
+	require.NotNil(c.t, lookup.Expiry)
+
+	c.log.Debug("Stale version is refused")
+	status := false
+	_, err = c.model.Update(item.Key, "", 1, UrlChanges{Status: &status})
+	assert.True(c.t, errors.Is(err, ErrVersionConflict))
+
+	c.log.Debug("Zero time clears the expiry")
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{Expire: &time.Time{}})
+	require.NoError(c.t, err)
+	lookup, err = c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	assert.Nil(c.t, lookup.Expiry)
+
+	c.log.Debug("Items of other owners are not found")
+	_, err = c.model.Update(item.Key, "marketing", 0, UrlChanges{Status: &status})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+
+	c.log.Debug("Cache failure does not undo a committed update")
+	title := "Typo fixed"
+	c.mr.SetError("redis is down")
+	updated, err = c.model.Update(item.Key, "", 0, UrlChanges{Title: &title})
+	c.mr.SetError("")
+	require.NoError(c.t, err)
+	stored, err := c.model.Get(item.Key, "")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, title, stored.Title)
+	assert.Equal(c.t, updated.Version, stored.Version)
+}
+
+func (c testCases) testHistory() {
+	item, err := c.model.GenerateWithOptions("http://promo.com/spring", GenerateOptions{Owner: "marketing"})
+	require.NoError(c.t, err)
+
+	c.log.Debug("Every change is recorded with its actor")
+	origin := "http://promo.com/summer"
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{Origin: &origin, Actor: "admin", Reason: "new season"})
+	require.NoError(c.t, err)
+	_, err = c.model.Delete(item.Key, "admin")
+	require.NoError(c.t, err)
+
+	revisions, err := c.model.History(item.Key)
+	require.NoError(c.t, err)
+	require.Len(c.t, revisions, 3)
+	assert.Equal(c.t, uint(3), revisions[0].Revision)
+	assert.Equal(c.t, ReasonDelete, revisions[0].Reason)
+	assert.False(c.t, revisions[0].Status)
+	assert.Equal(c.t, "new season", revisions[1].Reason)
+	assert.Equal(c.t, origin, revisions[1].Origin)
+	assert.Equal(c.t, "marketing", revisions[2].Actor)
+	assert.Equal(c.t, ReasonCreate, revisions[2].Reason)
+
+	c.log.Debug("Rollback restores the revision, the cache follows")
+	restored, err := c.model.Rollback(item.Key, 1, 0, "admin", "")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, uint(4), restored.Version)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	assert.True(c.t, lookup.Status)
+	assert.Equal(c.t, "http://promo.com/spring", lookup.Origin)
+	revisions, err = c.model.History(item.Key)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, "rollback to revision 1", revisions[0].Reason)
+
+	c.log.Debug("Rule edits are recorded and rolled back")
+	rules := RedirectRules{{Name: "ios", OS: []string{"iOS"}, Target: "http://promo.com/app"}}
+	title := "Spring promo"
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{Rules: &rules, Title: &title, Actor: "marketing"})
+	require.NoError(c.t, err)
+	revisions, err = c.model.History(item.Key)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, rules, revisions[0].Rules)
+	assert.Equal(c.t, title, revisions[0].Title)
+	assert.Empty(c.t, revisions[1].Rules)
+	_, err = c.model.Rollback(item.Key, revisions[1].Revision, 0, "admin", "")
+	require.NoError(c.t, err)
+	lookup, err = c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	assert.Empty(c.t, lookup.Rules)
+	assert.Empty(c.t, lookup.Title)
+
+	c.log.Debug("Unknown revision is not found")
+	_, err = c.model.Rollback(item.Key, 42, 0, "admin", "")
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+
+	c.log.Debug("Item is not created without its first revision")
+	require.NoError(c.t, c.db.Migrator().RenameTable(&UrlRevision{}, "url_revisions_off"))
+	_, err = c.model.Generate("http://promo.com/lost", nil)
+	assert.Error(c.t, err)
+	require.NoError(c.t, c.db.Migrator().RenameTable("url_revisions_off", &UrlRevision{}))
+	var count int64
+	require.NoError(c.t, c.db.Model(&Url{}).Where("origin = ?", "http://promo.com/lost").Count(&count).Error)
+	assert.Equal(c.t, int64(0), count)
+}
+
+func (c testCases) testPurge() {
+	item, err := c.model.GenerateWithOptions("http://personal.com", GenerateOptions{Alias: "gdpr-me"})
+	require.NoError(c.t, err)
+
+	c.log.Debug("Only deleted items are restored")
+	_, err = c.model.Restore(item.Key, "admin")
+	assert.True(c.t, errors.Is(err, ErrNotDeleted))
+	_, err = c.model.Delete(item.Key, "admin")
+	require.NoError(c.t, err)
+	deleted, err := c.model.Get(item.Key, "")
+	require.NoError(c.t, err)
+	assert.NotNil(c.t, deleted.DeletedAt)
+	restored, err := c.model.Restore(item.Key, "admin")
+	require.NoError(c.t, err)
+	assert.True(c.t, restored.Status)
+	assert.Nil(c.t, restored.DeletedAt)
+	_, err = c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+
+	c.log.Debug("Purge removes the item, its history and counters")
+	require.NoError(c.t, c.model.CountVisitor(item.Key, "203.0.113.42", "Chrome"))
+	require.NoError(c.t, c.redis.HSet(context.Background(), QrCacheKey(item.Key), "png-256-M-4-false", "image").Err())
+	require.NoError(c.t, c.model.Purge(item.Key))
+	_, err = c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+	revisions, err := c.model.History(item.Key)
+	require.NoError(c.t, err)
+	assert.Empty(c.t, revisions)
+	assert.Equal(c.t, int64(0), c.redis.Exists(context.Background(), visitorsKey(item.Key), dailyVisitorsKey(item.Key, time.Now()), QrCacheKey(item.Key)).Val())
+
+	c.log.Debug("Purged codes are tombstoned")
+	_, err = c.model.GenerateWithOptions("http://other.com", GenerateOptions{Alias: "GDPR-me"})
+	assert.True(c.t, errors.Is(err, ErrAliasTaken))
+	taken, err := c.model.isKeyTaken("gdpr-me")
+	require.NoError(c.t, err)
+	assert.True(c.t, taken)
+
+	c.log.Debug("Retention job purges the items deleted for too long")
+	viper.Set(keyPurgeRetentionDays, 30)
+	defer viper.Set(keyPurgeRetentionDays, 0)
+	old, err := c.model.Generate("http://old.com", nil)
+	require.NoError(c.t, err)
+	recent, err := c.model.Generate("http://recent.com", nil)
+	require.NoError(c.t, err)
+	for _, key := range []string{old.Key, recent.Key} {
+		_, err = c.model.Delete(key, "admin")
+		require.NoError(c.t, err)
+	}
+	require.NoError(c.t, c.db.Model(&Url{}).Where("`key` = ?", old.Key).
+		UpdateColumn("deleted_at", time.Now().AddDate(0, 0, -31)).Error)
+	purger, err := NewRetentionPurger(c.log, c.redis, c.db)
+	require.NoError(c.t, err)
+	purged, err := purger.Purge(context.Background(), time.Now())
+	require.NoError(c.t, err)
+	assert.Equal(c.t, 1, purged)
+	_, err = c.model.Get(old.Key, "")
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+	_, err = c.model.Get(recent.Key, "")
+	require.NoError(c.t, err)
+
+	c.log.Debug("Item restored between the pluck and the purge is kept")
+	restoring, err := c.model.Generate("http://restoring.com", nil)
+	require.NoError(c.t, err)
+	_, err = c.model.Delete(restoring.Key, "admin")
+	require.NoError(c.t, err)
+	require.NoError(c.t, c.db.Model(&Url{}).Where("`key` = ?", restoring.Key).
+		UpdateColumn("deleted_at", time.Now().AddDate(0, 0, -31)).Error)
+	var due []string
+	require.NoError(c.t, c.db.Model(&Url{}).Where("state = ? AND deleted_at < ?", StateDeleted, time.Now().AddDate(0, 0, -30)).
+		Pluck("key", &due).Error)
+	assert.Equal(c.t, []string{restoring.Key}, due)
+	_, err = c.model.Restore(restoring.Key, "admin")
+	require.NoError(c.t, err)
+	before := time.Now().AddDate(0, 0, -30)
+	ok, err := c.model.purge(restoring.Key, &before)
+	require.NoError(c.t, err)
+	assert.False(c.t, ok)
+	kept, err := c.model.Get(restoring.Key, "")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, StateActive, kept.State)
+	revisions, err = c.model.History(restoring.Key)
+	require.NoError(c.t, err)
+	assert.NotEmpty(c.t, revisions)
+
+	c.log.Debug("Retention job leaves the lock of another instance alone")
+	ctx := context.Background()
+	require.NoError(c.t, c.redis.Set(ctx, purgeLock, "other", time.Minute).Err())
+	purged, err = purger.Purge(ctx, time.Now())
+	require.NoError(c.t, err)
+	assert.Equal(c.t, 0, purged)
+	assert.Equal(c.t, "other", c.redis.Get(ctx, purgeLock).Val())
+	assert.Equal(c.t, int64(0), releaseLockScript.Run(ctx, c.redis, []string{purgeLock}, "mine").Val())
+	assert.Equal(c.t, "other", c.redis.Get(ctx, purgeLock).Val())
+	require.NoError(c.t, c.redis.Del(ctx, purgeLock).Err())
+
+	c.log.Debug("Retention job releases its own lock")
+	_, err = purger.Purge(ctx, time.Now())
+	require.NoError(c.t, err)
+	assert.Equal(c.t, int64(0), c.redis.Exists(ctx, purgeLock).Val())
+}
+
+func (c testCases) testStates() {
+	item, err := c.model.GenerateWithOptions("http://suspicious.com", GenerateOptions{Owner: "marketing"})
+	require.NoError(c.t, err)
+	assert.Equal(c.t, StateActive, item.State)
+
+	c.log.Debug("Flagged item is returned with its reason")
+	flagged := StateFlagged
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{State: &flagged, Actor: "admin", Reason: "reported as phishing"})
+	require.NoError(c.t, err)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrFlagged))
+	require.NotNil(c.t, lookup)
+	assert.Equal(c.t, "reported as phishing", lookup.StateReason)
+	assert.True(c.t, lookup.Status)
+
+	c.log.Debug("Owners only delete and restore their items")
+	active := StateActive
+	_, err = c.model.Update(item.Key, "marketing", 0, UrlChanges{State: &active})
+	assert.True(c.t, errors.Is(err, ErrInvalidTransition))
+
+	c.log.Debug("Transitions follow the state machine")
+	banned, takedown, deleted := StateBanned, StateTakenDown, StateDeleted
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{State: &banned, Actor: "admin", Reason: "phishing"})
+	require.NoError(c.t, err)
+	_, err = c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrBanned))
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{State: &takedown, Actor: "admin"})
+	require.NoError(c.t, err)
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{State: &deleted, Actor: "admin"})
+	assert.True(c.t, errors.Is(err, ErrInvalidTransition))
+	_, err = c.model.FindByShortCode(item.Key, false)
+	assert.True(c.t, errors.Is(err, ErrTakenDown))
+
+	revisions, err := c.model.History(item.Key)
+	require.NoError(c.t, err)
+	require.Len(c.t, revisions, 4)
+	assert.Equal(c.t, StateTakenDown, revisions[0].State)
+	assert.Equal(c.t, "phishing", revisions[1].Reason)
+
+	c.log.Debug("Items disabled before states existed are migrated as deleted")
+	legacy, err := c.model.Generate("http://legacy.com", nil)
+	require.NoError(c.t, err)
+	require.NoError(c.t, c.db.Model(&Url{}).Where("`key` = ?", legacy.Key).
+		UpdateColumn("status", false).Error)
+	require.NoError(c.t, c.db.Migrator().DropColumn(&Url{}, "state"))
+	require.NoError(c.t, c.db.Migrator().DropColumn(&Url{}, "deleted_at"))
+	model, err := NewUrlModel(c.log, c.redis, c.db)
+	require.NoError(c.t, err)
+	migrated, err := model.Get(legacy.Key, "")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, StateDeleted, migrated.State)
+	assert.NotNil(c.t, migrated.DeletedAt)
+
+	c.log.Debug("The migration runs once, later boots leave the items alone")
+	require.NoError(c.t, c.db.Model(&Url{}).Where("`key` = ?", legacy.Key).
+		Updates(map[string]interface{}{"state": StateActive, "deleted_at": nil}).Error)
+	_, err = NewUrlModel(c.log, c.redis, c.db)
+	require.NoError(c.t, err)
+	migrated, err = model.Get(legacy.Key, "")
+	require.NoError(c.t, err)
+	assert.Equal(c.t, StateActive, migrated.State)
+	assert.Nil(c.t, migrated.DeletedAt)
+}
+
+func TestDestination(t *testing.T) {
+	item := Url{
+		Origin: "http://example.com/path?ref=link",
+		Utm:    UtmParams{Source: "newsletter", Campaign: "spring"},
+	}
+	incoming := url.Values{"ref": {"visitor"}, "lang": {"en"}}
+
+	assert.Equal(t, "http://example.com/path?ref=link&utm_campaign=spring&utm_source=newsletter", item.Destination(incoming))
+
+	item.QueryPassthrough = PassthroughPreserve
+	assert.Equal(t, "http://example.com/path?lang=en&ref=link&utm_campaign=spring&utm_source=newsletter", item.Destination(incoming))
+
+	item.QueryPassthrough = PassthroughOverride
+	assert.Equal(t, "http://example.com/path?lang=en&ref=visitor&utm_campaign=spring&utm_source=newsletter", item.Destination(incoming))
+
+	item.Origin = "http://example.com/?utm_source=site"
+	item.QueryPassthrough = PassthroughNone
+	assert.Equal(t, "http://example.com/?utm_campaign=spring&utm_source=site", item.Destination(nil))
+}
+
+func (c testCases) testRules() {
+	c.log.Debug("Generate routed item, its rules are stored and cached in order")
+	launch := time.Now().Add(time.Hour)
+	rules := RedirectRules{
+		{Name: "ios", OS: []string{"iOS"}, Target: "https://apps.apple.com/app/id1"},
+		{Languages: []string{"de"}, Target: "http://routed.com/de"},
+		{After: &launch, Target: "http://routed.com/archive"},
+	}
+	item, err := c.model.GenerateWithOptions("http://routed.com", GenerateOptions{Rules: rules})
+	require.NoError(c.t, err)
+	for _, cache := range []bool{false, true} {
+		lookup, err := c.model.FindByShortCode(item.Key, false)
+		require.NoError(c.t, err, "cache %v", cache)
+		require.Len(c.t, lookup.Rules, 3)
+		assert.Equal(c.t, "ios", lookup.Rules[0].Name)
+		assert.True(c.t, launch.Equal(*lookup.Rules[2].After))
+	}
+
+	c.log.Debug("Visitors are routed by the first matching rule, the others go to the origin")
+	now := time.Now()
+	route := func(v Visitor) Routing {
+		routing, err := item.Route(v, nil)
+		require.NoError(c.t, err)
+		return routing
+	}
+	assert.Equal(c.t, Routing{Destination: "https://apps.apple.com/app/id1", Rule: "ios"},
+		route(Visitor{OS: "iOS", AcceptLanguage: "de-DE", Time: now}))
+	assert.Equal(c.t, Routing{Destination: "http://routed.com/de", Rule: "#2"},
+		route(Visitor{OS: "Android", AcceptLanguage: "de-DE,en;q=0.5", Time: now}))
+	assert.Equal(c.t, Routing{Destination: "http://routed.com"},
+		route(Visitor{AcceptLanguage: "en-US,de;q=0.8", Time: now}))
+	assert.Equal(c.t, "http://routed.com/archive", route(Visitor{Time: launch.Add(time.Minute)}).Destination)
+
+	c.log.Debug("Rules without target or with an empty window are refused")
+	_, err = c.model.GenerateWithOptions("http://routed.com", GenerateOptions{Rules: RedirectRules{{OS: []string{"iOS"}}}})
+	assert.True(c.t, errors.Is(err, ErrInvalidRule))
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{Rules: &RedirectRules{{After: &launch, Before: &now, Target: "http://routed.com"}}})
+	assert.True(c.t, errors.Is(err, ErrInvalidRule))
+
+	c.log.Debug("Update with empty rules removes them, routed items are never reused")
+	_, err = c.model.FindReusable("http://routed.com", GenerateOptions{})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+	updated, err := c.model.Update(item.Key, "", 0, UrlChanges{Rules: &RedirectRules{}})
+	require.NoError(c.t, err)
+	assert.Empty(c.t, updated.Rules)
+	reused, err := c.model.FindReusable("http://routed.com", GenerateOptions{})
+	require.NoError(c.t, err)
+	assert.Equal(c.t, item.Key, reused.Key)
+}
+
+func (c testCases) testVariants() {
+	c.log.Debug("Generate split item, visitors are spread by the weights of the variants")
+	item, err := c.model.GenerateWithOptions("http://split.com", GenerateOptions{Variants: Variants{
+		{Name: "a", Target: "http://split.com/a", Weight: 70},
+		{Name: "b", Target: "http://split.com/b", Weight: 30},
+		{Name: "paused", Target: "http://split.com/c"},
+	}})
+	require.NoError(c.t, err)
+	lookup, err := c.model.FindByShortCode(item.Key, false)
+	require.NoError(c.t, err)
+	require.Len(c.t, lookup.Variants, 3)
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		routing, err := lookup.Route(Visitor{}, nil)
+		require.NoError(c.t, err)
+		counts[routing.Variant]++
+	}
+	assert.InDelta(c.t, 700, counts["a"], 100)
+	assert.InDelta(c.t, 300, counts["b"], 100)
+	assert.Zero(c.t, counts["paused"])
+
+	c.log.Debug("Visitors keep their variant while it has weight")
+	routing, err := lookup.Route(Visitor{Variant: "b"}, nil)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, Routing{Destination: "http://split.com/b", Variant: "b"}, routing)
+	routing, err = lookup.Route(Visitor{Variant: "paused"}, nil)
+	require.NoError(c.t, err)
+	assert.NotEqual(c.t, "paused", routing.Variant)
+
+	c.log.Debug("Hashed splits always send a visitor to the same variant")
+	hash := SplitHash
+	updated, err := c.model.Update(item.Key, "", 0, UrlChanges{SplitMode: &hash})
+	require.NoError(c.t, err)
+	first, err := updated.Route(Visitor{Key: "10.0.0.1|Firefox"}, nil)
+	require.NoError(c.t, err)
+	for i := 0; i < 10; i++ {
+		routing, err := updated.Route(Visitor{Key: "10.0.0.1|Firefox"}, nil)
+		require.NoError(c.t, err)
+		assert.Equal(c.t, first, routing)
+	}
+
+	c.log.Debug("Variants without weight, with duplicated names or names cookies alter are refused")
+	_, err = c.model.GenerateWithOptions("http://split.com", GenerateOptions{Variants: Variants{{Target: "http://split.com/a"}}})
+	assert.True(c.t, errors.Is(err, ErrInvalidVariant))
+	_, err = c.model.GenerateWithOptions("http://split.com", GenerateOptions{Variants: Variants{{Name: "café", Target: "http://split.com/a", Weight: 1}}})
+	assert.True(c.t, errors.Is(err, ErrInvalidVariant))
+	_, err = c.model.Update(item.Key, "", 0, UrlChanges{Variants: &Variants{
+		{Name: "a", Target: "http://split.com/a", Weight: 1},
+		{Name: "a", Target: "http://split.com/b", Weight: 1},
+	}})
+	assert.True(c.t, errors.Is(err, ErrInvalidVariant))
+	_, err = c.model.FindReusable("http://split.com", GenerateOptions{})
+	assert.True(c.t, errors.Is(err, ErrNotFound))
+}
+
+func TestRuleMatches(t *testing.T) {
+	rule := RedirectRule{
+		Countries: []string{"DE", "AT"},
+		Devices:   []string{DeviceMobile},
+		Referrers: []string{"example.com"},
+		Target:    "http://example.com/de",
+	}
+	visitor := Visitor{Country: "de", Device: DeviceMobile, Referrer: "https://news.example.com/post"}
+	assert.True(t, rule.Matches(visitor))
+
+	visitor.Referrer = "https://notexample.com/"
+	assert.False(t, rule.Matches(visitor))
+
+	visitor.Referrer = "https://example.com/"
+	visitor.Country = "FR"
+	assert.False(t, rule.Matches(visitor))
+
+	assert.Equal(t, "de-AT", preferredLanguage("en;q=0.7, de-AT, *;q=0.1"))
+	assert.Equal(t, "", preferredLanguage(""))
+	assert.True(t, RedirectRule{Target: "http://example.com"}.Matches(Visitor{}))
+}
+
+func TestDeepLinkHandoff(t *testing.T) {
+	link := DeepLink{
+		Ios:      "exampleapp://item/1",
+		IosStore: "https://apps.apple.com/app/id1",
+		Android:  "intent://item/1#Intent;scheme=exampleapp;end",
+		Web:      "http://example.com/app",
+	}
+
+	app, fallback := link.Handoff(PlatformIOS, "http://example.com")
+	assert.Equal(t, "exampleapp://item/1", app)
+	assert.Equal(t, "https://apps.apple.com/app/id1", fallback)
+
+	app, fallback = link.Handoff(PlatformAndroid, "http://example.com")
+	assert.Equal(t, "intent://item/1#Intent;scheme=exampleapp;end", app)
+	assert.Equal(t, "http://example.com/app", fallback)
+
+	app, _ = link.Handoff("", "http://example.com")
+	assert.Empty(t, app)
+
+	link.Web = ""
+	_, fallback = link.Handoff(PlatformAndroid, "http://example.com")
+	assert.Equal(t, "http://example.com", fallback)
+
+	assert.True(t, ValidAppUrl("https://example.com/item/1"))
+	assert.False(t, ValidAppUrl("JavaScript:alert(1)"))
+	assert.False(t, ValidAppUrl("item/1"))
+	assert.True(t, errors.Is(validateDeepLink(DeepLink{Android: "data:text/html,hi"}), ErrInvalidDeepLink))
 }
 
 func TestUrl(t *testing.T) {
@@ -196,6 +923,7 @@ func TestUrl(t *testing.T) {
 		t:     t,
 		model: urlModel,
 		redis: client,
+		mr:    mr,
 		db:    db,
 		log:   log,
 	}
@@ -204,4 +932,15 @@ func TestUrl(t *testing.T) {
 	testCase.testFindByShortCode()
 	testCase.testDeleteItem()
 	testCase.testGetListItem()
+	testCase.testAlias()
+	testCase.testDedupe()
+	testCase.testPassword()
+	testCase.testMaxClicks()
+	testCase.testActiveFrom()
+	testCase.testUpdate()
+	testCase.testHistory()
+	testCase.testPurge()
+	testCase.testStates()
+	testCase.testRules()
+	testCase.testVariants()
 }
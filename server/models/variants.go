@@ -0,0 +1,145 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// maxVariants bounds the variants of an item, the stats list them all
+const maxVariants = topValues
+
+// Split modes of the items, an empty mode is a random split
+const (
+	// SplitRandom draws the variant of new visitors, who keep it by a cookie
+	SplitRandom = "random"
+	// SplitHash picks the variant from a hash of the visitor, no cookie is needed
+	SplitHash = "hash"
+)
+
+var (
+	ErrInvalidVariant = errors.New("Invalid Variant")
+)
+
+// variantNamePattern keeps names to the characters cookie values keep as
+// they are, visitors would lose their variant otherwise
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Variant is a destination of a split item, visitors are sent to the
+// variants in proportion of their weights
+type Variant struct {
+	// Name is recorded with the clicks and kept in the cookie of the visitors
+	Name   string `json:"name,omitempty"`
+	Target string `json:"target"`
+	// Weight 0 pauses the variant
+	Weight uint `json:"weight"`
+}
+
+// Variants are the destinations of a split item, stored as json
+type Variants []Variant
+
+// Value stores the variants as json, no variants as NULL
+func (variants Variants) Value() (driver.Value, error) {
+	return jsonValue(variants, len(variants) == 0)
+}
+
+// Scan reads the variants stored as json
+func (variants *Variants) Scan(value interface{}) error {
+	*variants = nil
+	return scanJSON(value, variants)
+}
+
+// ValidVariantName reports whether a variant name can be kept in a cookie
+func ValidVariantName(name string) bool {
+	return variantNamePattern.MatchString(name)
+}
+
+// Label returns the name of a variant, its position when it has no name
+func (v Variant) Label(position int) string {
+	if len(v.Name) != 0 {
+		return v.Name
+	}
+
+	return fmt.Sprintf("#%d", position+1)
+}
+
+// chooseVariant returns the position of the variant of a visitor. Visitors
+// keep the variant assigned to them while it has weight.
+func (u Url) chooseVariant(v Visitor) (int, error) {
+	var total uint64
+	for i, variant := range u.Variants {
+		if variant.Weight != 0 && len(v.Variant) != 0 && variant.Label(i) == v.Variant {
+			return i, nil
+		}
+		total += uint64(variant.Weight)
+	}
+
+	if total == 0 {
+		return 0, errors.Wrap(ErrInvalidVariant, "no variant has weight")
+	}
+
+	var n uint64
+	if u.SplitMode == SplitHash {
+		h := fnv.New64a()
+		h.Write([]byte(u.Key))
+		h.Write([]byte{0})
+		h.Write([]byte(v.Key))
+		n = h.Sum64() % total
+	} else {
+		r, err := rand.Int(rand.Reader, new(big.Int).SetUint64(total))
+		if err != nil {
+			return 0, errors.Wrap(err, "rand.Int")
+		}
+		n = r.Uint64()
+	}
+
+	for i, variant := range u.Variants {
+		if n < uint64(variant.Weight) {
+			return i, nil
+		}
+		n -= uint64(variant.Weight)
+	}
+
+	return len(u.Variants) - 1, nil
+}
+
+// validateVariants checks the labels and the weights of the variants of an item
+func validateVariants(variants Variants) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	if len(variants) > maxVariants {
+		return errors.Wrapf(ErrInvalidVariant, "more than %d variants", maxVariants)
+	}
+
+	var total uint
+	labels := map[string]bool{}
+	for i, variant := range variants {
+		label := variant.Label(i)
+		if labels[label] {
+			return errors.Wrapf(ErrInvalidVariant, "variant %s is duplicated", label)
+		}
+		labels[label] = true
+
+		if len(variant.Name) != 0 && !ValidVariantName(variant.Name) {
+			return errors.Wrapf(ErrInvalidVariant, "variant name %q has unsupported characters", variant.Name)
+		}
+
+		if len(variant.Target) == 0 {
+			return errors.Wrapf(ErrInvalidVariant, "variant %s has no target", label)
+		}
+		total += variant.Weight
+	}
+
+	if total == 0 {
+		return errors.Wrap(ErrInvalidVariant, "no variant has weight")
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	keyVisitorsRetentionDays = "visitors.retentionDays"
+	// keyVisitorsSecret keys the fingerprints of the visitors, generated once
+	// and kept in redis when empty
+	keyVisitorsSecret = "visitors.secret"
+)
+
+// dayFormat names the daily keys of the unique visitors
+const dayFormat = "20060102"
+
+// visitorsSecretKey keeps the generated secret shared by every instance
+const visitorsSecretKey = "visitors-secret"
+
+func visitorsKey(code string) string {
+	return strings.Join([]string{"visitors", code}, "-")
+}
+
+func dailyVisitorsKey(code string, day time.Time) string {
+	return strings.Join([]string{"visitors", code, day.UTC().Format(dayFormat)}, "-")
+}
+
+// visitorsSecret caches the secret keying the fingerprints. It never rotates:
+// the daily sets are merged over periods and the lifetime set spans every
+// day, a visitor has to keep its fingerprint across days to be counted once.
+// Hyperloglogs don't keep the fingerprints, only a few bits of their hash.
+type visitorsSecret struct {
+	mu     sync.Mutex
+	secret string
+}
+
+func (s *visitorsSecret) get(ctx context.Context, client *redis.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.secret) != 0 {
+		return s.secret, nil
+	}
+
+	if secret := viper.GetString(keyVisitorsSecret); len(secret) != 0 {
+		s.secret = secret
+		return secret, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "rand.Read")
+	}
+
+	// The first instance picks the secret
+	if err := client.SetNX(ctx, visitorsSecretKey, hex.EncodeToString(b), 0).Err(); err != nil {
+		return "", errors.Wrap(err, "client.SetNX")
+	}
+	secret, err := client.Get(ctx, visitorsSecretKey).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "client.Get")
+	}
+
+	s.secret = secret
+	return secret, nil
+}
+
+func init() {
+	viper.SetDefault(keyVisitorsRetentionDays, 400)
+}
+
+// CountVisitor adds a visitor to the unique visitors of a code. Only a keyed
+// hash of the ip and user agent is kept.
+func (u *UrlModel) CountVisitor(shortCode, ip, userAgent string) error {
+	return u.countVisitor(shortCode, ip, userAgent, time.Now())
+}
+
+func (u *UrlModel) countVisitor(shortCode, ip, userAgent string, at time.Time) error {
+	ctx := context.Background()
+
+	secret, err := u.secret.get(ctx, u.redis)
+	if err != nil {
+		return errors.Wrap(err, "u.secret.get")
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{secret, ip, userAgent}, "\n")))
+	fingerprint := hex.EncodeToString(sum[:16])
+
+	daily := dailyVisitorsKey(shortCode, at)
+	retention := time.Duration(viper.GetInt(keyVisitorsRetentionDays)) * 24 * time.Hour
+	if _, err := u.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.PFAdd(ctx, daily, fingerprint)
+		pipe.Expire(ctx, daily, retention)
+		pipe.PFAdd(ctx, visitorsKey(shortCode), fingerprint)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "u.redis.Pipelined")
+	}
+
+	return nil
+}
+
+// mergeCounters adds the counters kept in redis to listed items
+func (u *UrlModel) mergeCounters(items []*Url) {
+	if err := u.mergePendingHits(items); err != nil {
+		u.log.With(zap.Error(err)).Error("u.mergePendingHits")
+	}
+
+	if err := u.mergeUniqueVisitors(items); err != nil {
+		u.log.With(zap.Error(err)).Error("u.mergeUniqueVisitors")
+	}
+}
+
+// mergeUniqueVisitors sets the lifetime unique visitors of the items
+func (u *UrlModel) mergeUniqueVisitors(items []*Url) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	counts := make([]*redis.IntCmd, len(items))
+	if _, err := u.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, item := range items {
+			counts[i] = pipe.PFCount(ctx, visitorsKey(item.Key))
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "u.redis.Pipelined")
+	}
+
+	for i, count := range counts {
+		items[i].UniqueVisitors = uint64(count.Val())
+	}
+
+	return nil
+}
+
+// uniqueVisitors counts the visitors of a code over the days between from
+// and to, each visitor once. Days older than the retention count nothing.
+func uniqueVisitors(ctx context.Context, client *redis.Client, code string, from, to time.Time) (uint64, error) {
+	var keys []string
+	for day := truncate(from, IntervalDay); day.Before(to); day = day.AddDate(0, 0, 1) {
+		keys = append(keys, dailyVisitorsKey(code, day))
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	count, err := client.PFCount(ctx, keys...).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "client.PFCount")
+	}
+
+	return uint64(count), nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/pkg/errors"
@@ -9,9 +10,21 @@ import (
 	"github.com/danielnguyentb/url-shortener/core"
 	"github.com/danielnguyentb/url-shortener/libs"
 	"github.com/danielnguyentb/url-shortener/libs/render"
+	"github.com/danielnguyentb/url-shortener/middlewares"
 	"github.com/danielnguyentb/url-shortener/server/controllers"
+	"github.com/danielnguyentb/url-shortener/server/models"
+	"github.com/danielnguyentb/url-shortener/web"
 )
 
+// adminListPath streams the admin list, longer than the request timeout
+const adminListPath = "/admin/list"
+
+// LongRequest reports whether a request is exempt from the request timeout,
+// its handler sets its own deadline
+func LongRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Path == adminListPath
+}
+
 func AddRoutes(r *core.Mux, log *zap.Logger) error {
 	// Init gorm with mysql
 	db, err := libs.NewMysqlWithViper(log)
@@ -25,24 +38,57 @@ func AddRoutes(r *core.Mux, log *zap.Logger) error {
 		return errors.Wrap(err, "libs.NewRedisFromViper")
 	}
 
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		render.JSON(w, r, map[string]string{
-			"status": "ok",
-		})
-	})
+	// Load html templates
+	if err := render.LoadTemplates(web.FS, web.LayoutsPattern, web.PagesPattern); err != nil {
+		return errors.Wrap(err, "render.LoadTemplates")
+	}
+
+	// Write the hits counted in redis to the database
+	go models.NewHitFlusher(log, redis, db).Run(context.Background())
+
+	// Purge the urls deleted for longer than the retention
+	purger, err := models.NewRetentionPurger(log, redis, db)
+	if err != nil {
+		return errors.Wrap(err, "models.NewRetentionPurger")
+	}
+	go purger.Run(context.Background())
 
 	urlCtrl, err := controllers.NewUrlController(log, redis, db)
 	if err != nil {
 		return errors.Wrap(err, "controllers.NewUrlController")
 	}
+	r.Method(http.MethodGet, "/", middlewares.CSRF(http.HandlerFunc(urlCtrl.Home)))
+	r.Method(http.MethodPost, "/shorten", middlewares.CSRF(http.HandlerFunc(urlCtrl.Shorten)))
+	r.Method(http.MethodGet, "/static/", http.StripPrefix("/static/", http.FileServer(http.FS(web.Static()))))
 	r.Post("/create", urlCtrl.CreateShorten)
+	r.Get("/r/:code/qr", urlCtrl.QrCode)
 	r.Get("/r/:code", urlCtrl.Redirect)
+	r.Head("/r/:code", urlCtrl.Redirect)
+	r.Method(http.MethodPost, "/r/:code", middlewares.CSRFUnless(controllers.RedirectCSRFExempt)(http.HandlerFunc(urlCtrl.Redirect)))
+	r.Get("/p/:code", urlCtrl.Preview)
+	r.Get("/links/:code", urlCtrl.GetLink)
+	r.Patch("/links/:code", urlCtrl.UpdateLink)
+	r.NotFound(controllers.NotFound)
+
+	wellKnownCtrl, err := controllers.NewWellKnownController(log)
+	if err != nil {
+		return errors.Wrap(err, "controllers.NewWellKnownController")
+	}
+	r.Get("/.well-known/apple-app-site-association", wellKnownCtrl.AppleAppSiteAssociation)
+	r.Get("/.well-known/assetlinks.json", wellKnownCtrl.AssetLinks)
 
 	adminCtrl, err := controllers.NewAdminController(log, redis, db)
 	if err != nil {
 		return errors.Wrap(err, "controllers.NewAdminController")
 	}
-	r.Get("/admin/list", adminCtrl.GetList)
+	r.Get(adminListPath, adminCtrl.GetList)
+	r.Get("/admin/links/:code/stats", adminCtrl.Stats)
+	r.Get("/admin/links/:code", adminCtrl.Get)
+	r.Patch("/admin/links/:code", adminCtrl.Update)
+	r.Get("/admin/links/:code/history", adminCtrl.History)
+	r.Post("/admin/links/:code/rollback/:rev", adminCtrl.Rollback)
+	r.Post("/admin/links/:code/restore", adminCtrl.Restore)
+	r.Delete("/admin/links/:code", adminCtrl.Delete)
 	r.Delete("/admin/:code", adminCtrl.Delete)
 
 	return nil
@@ -0,0 +1,28 @@
+// Package web holds the templates and static assets of the browser frontend,
+// embedded into the binary.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+const (
+	// LayoutsPattern matches the layouts shared by every page
+	LayoutsPattern = "templates/layouts/*.html"
+	// PagesPattern matches the pages rendered by the controllers
+	PagesPattern = "templates/pages/*.html"
+)
+
+//go:embed templates static
+var FS embed.FS
+
+// Static returns the static assets rooted at the static directory
+func Static() fs.FS {
+	static, err := fs.Sub(FS, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return static
+}